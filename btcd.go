@@ -6,7 +6,9 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 
   "github.com/hlandauf/btcserver"
 	"github.com/hlandauf/btcd/limits"
@@ -15,14 +17,17 @@ import (
 )
 
 var log, Log = xlog.New("BTCD")
+
+// shutdownChannel is closed to request a graceful shutdown of btcdMain.
 var shutdownChannel = make(chan struct{})
 
 // btcdMain is the real main function for btcd.  It is necessary to work around
 // the fact that deferred functions do not run when os.Exit() is called.  The
 // optional serverChan parameter is mainly used by the service code to be
 // notified with the server once it is setup so it can gracefully stop it when
-// requested from the service control manager.
-func btcdMain(serverChan chan<- *btcserver.Server) error {
+// requested from the service control manager.  The progress of the shutdown is
+// reported through the optional smgr parameter.
+func btcdMain(serverChan chan<- *btcserver.Server, smgr service.Manager) error {
 	// Load configuration and parse command line.  This function also
 	// initializes logging and configures it accordingly.
 	tcfg, _, err := loadConfig()
@@ -30,6 +35,13 @@ func btcdMain(serverChan chan<- *btcserver.Server) error {
 		return err
 	}
   cfg := tcfg
+
+	// The configuration has been validated and printed by loadConfig when
+	// only checking it.
+	if cfg.CheckConfig {
+		return nil
+	}
+	defer logFile.Close()
 	defer xlog.Flush()
 
 	// Show version at startup.
@@ -41,12 +53,113 @@ func btcdMain(serverChan chan<- *btcserver.Server) error {
 		log.Errorf("%v", err)
 		return err
 	}
-	defer db.Close()
+
+	// The database is closed once, either on shutdown or when returning
+	// early, or rolled back and closed when the shutdown is aborted.
+	var dbCloseOnce sync.Once
+	closeDB := func(rollback bool) {
+		dbCloseOnce.Do(func() {
+			if rollback {
+				db.RollbackClose()
+			} else {
+				db.Close()
+			}
+		})
+	}
+	defer closeDB(false)
+
+	// Check the most recent blocks when requested, rolling back any which
+	// are inconsistent, for instance after an unclean shutdown.
+	if cfg.CheckDB > 0 {
+		err := checkBlockDB(db, cfg.CheckDB)
+		if err != nil {
+			log.Errorf("Block database check failed: %v", err)
+			return err
+		}
+	}
 
 	cfg.NodeConfig.DB = db
 
+	// Publish an onion service for the P2P listener via the Tor control
+	// port when requested.  This must happen before the server is created
+	// so the onion address is advertised along with the other external
+	// addresses.  Tor removes the service once the control connection is
+	// closed.
+	if cfg.TorControl != "" {
+		torCtl, err := startOnionService(cfg)
+		if err != nil {
+			log.Errorf("Unable to create onion service: %v", err)
+			return err
+		}
+		defer torCtl.Close()
+	}
+
+	// Start the I2P session when an I2P SAM bridge is specified so .i2p
+	// peers can be reached and, when listening, can connect to us.
+	if cfg.i2p != nil {
+		err := startI2PSession(cfg)
+		if err != nil {
+			log.Errorf("Unable to start I2P session: %v", err)
+			return err
+		}
+		defer cfg.i2p.Close()
+	}
+
+	// Generate a certificate pair for the RPC server on first start so it
+	// can use TLS without running gencerts first.
+	if !cfg.DisableRPC && bool(cfg.RPCAutoCert) &&
+		!fileExists(cfg.RPCConfig.Key) && !fileExists(cfg.RPCConfig.Cert) {
+
+		err := genCertPair(cfg.RPCConfig.Cert, cfg.RPCConfig.Key,
+			rpcCertHosts(cfg.RPCConfig.Listeners))
+		if err != nil {
+			log.Errorf("Unable to generate RPC certificate pair: %v", err)
+			return err
+		}
+	}
+
+	// Use cookie authentication for the RPC server when no credentials are
+	// configured.  The cookie is removed again on shutdown.
+	var cookiePath string
+	if !cfg.DisableRPC && cfg.RPCConfig.User == "" &&
+		cfg.RPCConfig.Pass == "" {
+
+		cookiePath = filepath.Join(cfg.DataDir, rpcCookieFilename)
+		user, pass, err := writeRPCCookie(cookiePath)
+		if err != nil {
+			log.Errorf("Unable to write RPC cookie: %v", err)
+			return err
+		}
+		defer os.Remove(cookiePath)
+		cfg.RPCConfig.User, cfg.RPCConfig.Pass = user, pass
+	}
+
+	// The RPC gateway authenticates RPC clients and serves the methods
+	// which control btcd itself.  It takes over the RPC listeners and moves
+	// the RPC server to a loopback address, so it is set up before the
+	// server.
+	var gateway *rpcGateway
+	if !cfg.DisableRPC {
+		gateway, err = setupRPCGateway(cfg)
+		if err != nil {
+			log.Errorf("Unable to start RPC gateway: %v", err)
+			return err
+		}
+		defer gateway.stop()
+	}
+
 	// Create server and start it.
-	server, err := btcserver.New(cfg)
+	var server *btcserver.Server
+	createServer := func() error {
+		var err error
+		server, err = btcserver.New(&cfg.Config)
+		return err
+	}
+	if gateway != nil {
+		err = gateway.createBackend(cfg, createServer)
+	} else {
+		err = createServer()
+	}
 	if err != nil {
 		// TODO(oga) this logging could do with some beautifying.
 		log.Errorf("Unable to start server on %v: %v",
@@ -55,27 +168,72 @@ func btcdMain(serverChan chan<- *btcserver.Server) error {
 	}
 
 	server.Start()
+	if gateway != nil {
+		gateway.start()
+	}
 	if serverChan != nil {
 		serverChan <- server
 	}
 
-	// Monitor for graceful server shutdown and signal the main goroutine
-	// when done. This is done in a separate goroutine rather than waiting
-	// directly so the main goroutine can be signaled for shutdown by either
-	// a graceful shutdown or from the main interrupt handler. This is
-	// necessary since the main goroutine must be kept running long enough
-	// for the interrupt handler goroutine to finish.
+	// Reload the configuration when requested via a signal.
+	reloadQuit := make(chan struct{})
+	defer close(reloadQuit)
+	go handleReloadSignals(cfg, reloadQuit)
+
+	// Wait until either a shutdown is requested by the service manager or
+	// the server shuts itself down, for instance via the stop RPC.
+	serverDone := make(chan struct{})
 	go func() {
 		server.WaitForShutdown()
-		log.Infof("Server shutdown complete")
-		shutdownChannel <- struct{}{}
+		close(serverDone)
 	}()
+	select {
+	case <-shutdownChannel:
+	case <-serverDone:
+	}
 
-	// Wait for shutdown signal from either a graceful server stop or from
-	// the interrupt handler.
-	<-shutdownChannel
-	log.Infof("Gracefully shutting down the database...")
-	db.RollbackClose()
+	// Shut down the server and then the database, bounded by the shutdown
+	// timeout.  When the shutdown is aborted, uncommitted changes to the
+	// database are rolled back so it is left consistent, but only once the
+	// server has stopped, since it may still be writing to the database
+	// until then.  Otherwise the database is left as after a crash, which
+	// its journal recovers from.
+	abortDB := func() {
+		select {
+		case <-serverDone:
+			closeDB(true)
+		default:
+			log.Warnf("The server is still running -- leaving the " +
+				"block database to recover on the next start")
+		}
+	}
+	var setStatus func(string)
+	if smgr != nil {
+		setStatus = smgr.SetStatus
+	}
+	shutdown := newShutdownCoordinator(cfg.ShutdownTimeout, setStatus)
+	if gateway != nil {
+		shutdown.add("RPC gateway", gateway.stop)
+	}
+	shutdown.add("server", func() {
+		server.Stop()
+		<-serverDone
+	})
+	shutdown.add("block database", func() {
+		closeDB(false)
+	})
+	if err := shutdown.run(abortDB); err != nil {
+		// Exit without running the deferred functions since they could
+		// block on the subsystems which did not stop.  The cookie is
+		// removed and the log flushed and closed here instead.
+		log.Errorf("%v", err)
+		if cookiePath != "" {
+			os.Remove(cookiePath)
+		}
+		xlog.Flush()
+		logFile.Close()
+		os.Exit(1)
+	}
 	log.Infof("Shutdown complete")
 	return nil
 }
@@ -93,22 +251,19 @@ func main() {
 		Name: "btcd",
 		Description: "Go-language full node Bitcoin daemon",
 		RunFunc: func(smgr service.Manager) error {
-
 			// btcdMain sends *Server on schan once it has finished
 			// starting.
 			schan := make(chan *btcserver.Server)
 			doneChan := make(chan error)
 			go func() {
-				doneChan <- btcdMain(schan)
+				doneChan <- btcdMain(schan, smgr)
 			}()
 
-			var s *btcserver.Server
-
 			select {
 			case err := <-doneChan:
 				// premature exit
 				return err
-			case s = <-schan:
+			case <-schan:
 			}
 
 			// server started, drop privileges and notify
@@ -122,7 +277,7 @@ func main() {
 			// wait for stop or spontaneous exit
 			select {
 				case <-smgr.StopChan():
-					s.Stop()
+					close(shutdownChannel)
 					return <-doneChan
 				case err := <-doneChan:
 					// spontaneous exit
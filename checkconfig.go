@@ -0,0 +1,163 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Sources of configuration values reported by --checkconfig.  Later sources
+// override earlier ones.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceCLI     = "cli"
+)
+
+// configField describes an option declared on the config struct.
+type configField struct {
+	long   string
+	short  string
+	masked bool
+	value  reflect.Value
+}
+
+// redactedOptions maps the options whose values may include a password to the
+// function which redacts it.  Unlike masked options, the rest of their value is
+// still shown.
+var redactedOptions = map[string]func(string) string{
+	"proxy":      redactURLPassword,
+	"proxyroute": redactProxyRoute,
+}
+
+// byLongName implements sort.Interface to sort options by their long name.
+type byLongName []configField
+
+func (s byLongName) Len() int           { return len(s) }
+func (s byLongName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLongName) Less(i, j int) bool { return s[i].long < s[j].long }
+
+// configFields returns all options declared on the passed config struct value,
+// including those of nested structs, in declaration order.  Options whose
+// default is masked in the help output, and passwords, are marked as secrets.
+func configFields(v reflect.Value, fields []configField) []configField {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		long := field.Tag.Get("long")
+		if long == "" {
+			if field.Type.Kind() == reflect.Struct {
+				fields = configFields(v.Field(i), fields)
+			}
+			continue
+		}
+		masked := field.Tag.Get("default-mask") == "-" ||
+			strings.HasSuffix(long, "pass")
+		fields = append(fields, configField{
+			long:   long,
+			short:  field.Tag.Get("short"),
+			masked: masked,
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+// configSources returns where the value of each option set anywhere other than
+// the defaults came from, keyed by long option name.  The passed file options
+// are the names of the options assigned by the config file and the files it
+// includes for the active network.
+func configSources(cfg *config, fileOptions []string, args []string) map[string]string {
+	fields := configFields(reflect.ValueOf(cfg).Elem(), nil)
+	shortNames := make(map[string]string, len(fields))
+	for _, f := range fields {
+		if f.short != "" {
+			shortNames[f.short] = f.long
+		}
+	}
+
+	sources := make(map[string]string)
+	for _, long := range fileOptions {
+		sources[long] = sourceFile
+	}
+	for _, f := range fields {
+		if _, ok, _ := lookupEnv(f.long); ok {
+			sources[f.long] = sourceEnv
+		}
+	}
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			long := strings.SplitN(arg[2:], "=", 2)[0]
+			sources[long] = sourceCLI
+
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			if long, ok := shortNames[arg[1:2]]; ok {
+				sources[long] = sourceCLI
+			}
+		}
+	}
+	return sources
+}
+
+// writeEffectiveConfig writes the value of every option along with its source
+// to w, sorted by option name.  The values of secrets such as passwords are
+// redacted, as are the passwords included in proxy URLs.
+func writeEffectiveConfig(w io.Writer, cfg *config, sources map[string]string) {
+	fields := configFields(reflect.ValueOf(cfg).Elem(), nil)
+	sort.Sort(byLongName(fields))
+
+	for _, f := range fields {
+		source, ok := sources[f.long]
+		if !ok {
+			source = sourceDefault
+		}
+		value := fmt.Sprintf("%v", f.value.Interface())
+		if redact, ok := redactedOptions[f.long]; ok {
+			value = fmt.Sprintf("%v", redactValue(f.value, redact))
+		}
+		if f.masked && !isEmptyValue(f.value) {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(w, "%s = %s (%s)\n", f.long, value, source)
+	}
+}
+
+// isEmptyValue returns whether the passed option value is empty, so there is
+// nothing to redact.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// redactValue returns the passed string or string slice option value with the
+// passed redaction function applied to each string.
+func redactValue(v reflect.Value, redact func(string) string) interface{} {
+	switch v.Kind() {
+	case reflect.String:
+		return redact(v.String())
+	case reflect.Slice:
+		values := make([]string, v.Len())
+		for i := range values {
+			values[i] = redact(v.Index(i).String())
+		}
+		return values
+	}
+	return v.Interface()
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hlandauf/btcchain"
+	"github.com/hlandauf/btcd/logformat"
+	"github.com/hlandauf/btcdb"
+	"github.com/hlandauf/btcwire"
+)
+
+// checkBlock verifies the block stored at the passed height.  It must hash to
+// the hash it is stored under, connect to the passed previous block, have a
+// merkle root matching its transactions, and all of its transactions must be
+// indexed as part of it.  The hash of the block is returned.
+func checkBlock(db btcdb.Db, height int64, prevHash *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	hash, err := db.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch hash: %v", err)
+	}
+	block, err := db.FetchBlockBySha(hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch block %v: %v", hash,
+			err)
+	}
+
+	// Hash the block again rather than trusting the index.
+	blockHash, err := block.Sha()
+	if err != nil {
+		return nil, err
+	}
+	if !blockHash.IsEqual(hash) {
+		return nil, fmt.Errorf("block %v hashes to %v", hash,
+			blockHash)
+	}
+	header := &block.MsgBlock().Header
+	if prevHash != nil && !header.PrevBlock.IsEqual(prevHash) {
+		return nil, fmt.Errorf("block %v does not connect to the "+
+			"previous block %v", hash, prevHash)
+	}
+	indexedHeight, err := db.FetchBlockHeightBySha(hash)
+	if err != nil || indexedHeight != height {
+		return nil, fmt.Errorf("block %v is not indexed at its height",
+			hash)
+	}
+
+	// The transactions must match the merkle root of the header, and be
+	// indexed as part of this block.
+	merkles := btcchain.BuildMerkleTreeStore(block)
+	if !header.MerkleRoot.IsEqual(merkles[len(merkles)-1]) {
+		return nil, fmt.Errorf("block %v has an invalid merkle root",
+			hash)
+	}
+	for _, tx := range block.Transactions() {
+		replies, err := db.FetchTxBySha(tx.Sha())
+		if err != nil {
+			return nil, fmt.Errorf("transaction %v of block %v is "+
+				"not indexed: %v", tx.Sha(), hash, err)
+		}
+		found := false
+		for _, reply := range replies {
+			if reply.Err == nil && reply.Height == height &&
+				reply.BlkSha.IsEqual(hash) {
+
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("transaction %v is not indexed "+
+				"as part of block %v", tx.Sha(), hash)
+		}
+	}
+	return hash, nil
+}
+
+// checkBlockDB checks the last depth blocks of the passed block database with
+// checkBlock, starting with the oldest of them.  When an inconsistent block is
+// found, the database is rolled back to the block before it so the blocks from
+// there on are downloaded again.
+func checkBlockDB(db btcdb.Db, depth int64) error {
+	_, newestHeight, err := db.NewestSha()
+	if err != nil {
+		return err
+	}
+	if newestHeight < 0 {
+		return nil
+	}
+	start := newestHeight - depth + 1
+	if start < 0 {
+		start = 0
+	}
+	log.Infof("Checking the block database from height %d to %d",
+		logformat.F("height", start), newestHeight)
+
+	var goodHash *btcwire.ShaHash
+	if start > 0 {
+		goodHash, err = db.FetchBlockShaByHeight(start - 1)
+		if err != nil {
+			return err
+		}
+	}
+	for height := start; height <= newestHeight; height++ {
+		hash, err := checkBlock(db, height, goodHash)
+		if err == nil {
+			goodHash = hash
+			continue
+		}
+
+		log.Warnf("Block database is inconsistent at height %d: %v",
+			logformat.F("height", height), err)
+		if goodHash == nil {
+			return errors.New("the genesis block is inconsistent -- " +
+				"the block database must be recreated")
+		}
+		log.Warnf("Rolling back the block database to block %v at "+
+			"height %d", logformat.F("hash", goodHash),
+			logformat.F("height", height-1))
+		if err := db.DropAfterBlockBySha(goodHash); err != nil {
+			return fmt.Errorf("unable to roll back to block %v: %v",
+				goodHash, err)
+		}
+		return nil
+	}
+
+	log.Infof("Block database check passed")
+	return nil
+}
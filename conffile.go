@@ -0,0 +1,227 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	flags "github.com/conformal/go-flags"
+)
+
+// includeOption is the name of the config file directive which reads the
+// options of another config file in its place.
+const includeOption = "include"
+
+// networkSections contains the names of the config file sections whose options
+// only apply when the corresponding network is active.
+var networkSections = map[string]bool{
+	"mainnet": true,
+	"testnet": true,
+	"regtest": true,
+	"simnet":  true,
+}
+
+// configEntry is an option assignment read from a config file.  The file and
+// line it was read from are kept so errors point to the right place when
+// several files are included.
+type configEntry struct {
+	name string
+	text string
+	file string
+	line uint
+}
+
+// configNetwork returns the name of the config file section which applies to
+// the network selected by the passed configuration.  Custom networks selected
+// with --netparams have no section.
+func configNetwork(cfg *config) string {
+	switch {
+	case cfg.TestNet3:
+		return "testnet"
+	case cfg.RegressionTest:
+		return "regtest"
+	case cfg.SimNet:
+		return "simnet"
+	case cfg.NetParams != "":
+		return ""
+	}
+	return "mainnet"
+}
+
+// configFileReader reads the option assignments of a config file and the files
+// it includes which apply to a network.
+type configFileReader struct {
+	network string
+	entries []configEntry
+
+	// sectioned is set when any of the files has a network section.
+	sectioned bool
+
+	// visiting contains the files currently being read so include cycles
+	// are detected.
+	visiting map[string]bool
+}
+
+// readConfigFile reads the option assignments of the passed config file, and
+// any files it includes, which apply to the passed network.  Options outside of
+// a network section apply to all networks, while those in a [mainnet],
+// [testnet], [regtest] or [simnet] section only apply to that network.  An
+// include directive is replaced by the options of the named file, whose path
+// is relative to the directory of the including file unless it is absolute.
+// Options the included file declares outside of a network section belong to
+// the section of the directive.  Whether any of the files read has a network
+// section is returned as well, even on error.
+func readConfigFile(path, network string) ([]configEntry, bool, error) {
+	r := &configFileReader{
+		network:  network,
+		visiting: make(map[string]bool),
+	}
+	if err := r.read(path, ""); err != nil {
+		return nil, r.sectioned, err
+	}
+	return r.entries, r.sectioned, nil
+}
+
+// readNetworkConfigFile reads the option assignments of the config file named
+// by the passed pre-parsed options which apply to the network they select.
+// When they don't select a network, the options of the config file outside of
+// the network sections may select one instead, unless the passed environment
+// options disable it.
+//
+// Config files without network sections were written before sections
+// existed, when the default config file wasn't read on the regression and
+// simulation test networks, and peers added by a config file were ignored on
+// the regression test network.  Such files are still treated that way.
+func readNetworkConfigFile(preCfg *config, so *serviceOptions, env *envOptions) ([]configEntry, error) {
+	network := configNetwork(preCfg)
+	testNetwork := network == "regtest" || network == "simnet"
+	entries, sectioned, err := readConfigFile(preCfg.ConfigFile, "")
+	if testNetwork && !sectioned && preCfg.ConfigFile == defaultConfigFile {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if network == "regtest" && !sectioned {
+		return removeConfigEntries(entries, "addpeer"), nil
+	}
+
+	if network == "mainnet" {
+		netCfg := *preCfg
+		netParser := newConfigParser(&netCfg, so, flags.IgnoreUnknown)
+		parseConfigEntries(netParser, entries)
+		env.disable(&netCfg)
+		network = configNetwork(&netCfg)
+	}
+	if network != "" {
+		entries, _, err = readConfigFile(preCfg.ConfigFile, network)
+	}
+	return entries, err
+}
+
+// removeConfigEntries returns the passed option assignments without those of
+// the named option.
+func removeConfigEntries(entries []configEntry, name string) []configEntry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.name != name {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// read appends the option assignments of the passed config file which apply to
+// the network of the reader to its entries.  The section is that of the
+// include directive for included files.
+func (r *configFileReader) read(path, section string) error {
+	if r.visiting[path] {
+		return fmt.Errorf("%s is included recursively", path)
+	}
+	r.visiting[path] = true
+	defer delete(r.visiting, path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileSection := section
+	scanner := bufio.NewScanner(file)
+	for line := uint(1); scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || text[0] == ';' || text[0] == '#':
+			continue
+
+		case text[0] == '[':
+			// Sections other than the network ones, such as
+			// [Application Options], contain options which apply
+			// to all networks.
+			name := strings.TrimSpace(strings.Trim(text, "[]"))
+			fileSection = section
+			if networkSections[strings.ToLower(name)] {
+				fileSection = strings.ToLower(name)
+				r.sectioned = true
+			}
+			continue
+		}
+		if fileSection != "" && fileSection != r.network {
+			continue
+		}
+
+		name, value := text, ""
+		if i := strings.Index(text, "="); i >= 0 {
+			name = strings.TrimSpace(text[:i])
+			value = strings.TrimSpace(text[i+1:])
+		}
+		if name != includeOption {
+			r.entries = append(r.entries, configEntry{
+				name: name,
+				text: text,
+				file: path,
+				line: line,
+			})
+			continue
+		}
+
+		include := cleanAndExpandPath(value)
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		if err := r.read(include, fileSection); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseConfigEntries parses the passed option assignments with the passed
+// parser.  Errors refer to the file and line the offending option was read
+// from.
+func parseConfigEntries(parser *flags.Parser, entries []configEntry) error {
+	var buf bytes.Buffer
+	buf.WriteString("[Application Options]\n")
+	for _, entry := range entries {
+		buf.WriteString(entry.text)
+		buf.WriteByte('\n')
+	}
+
+	err := flags.NewIniParser(parser).Parse(&buf)
+	if e, ok := err.(*flags.IniError); ok {
+		// The first line is the section header added above.
+		if i := int(e.LineNumber) - 2; i >= 0 && i < len(entries) {
+			e.File = entries[i].file
+			e.LineNumber = entries[i].line
+		}
+	}
+	return err
+}
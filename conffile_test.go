@@ -0,0 +1,257 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigFiles writes the passed config files, keyed by name, to the
+// passed directory.
+func writeConfigFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content),
+			0600)
+		if err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+	}
+}
+
+// configEntryNames returns the option names of the passed entries.
+func configEntryNames(entries []configEntry) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.name)
+	}
+	return names
+}
+
+// TestReadConfigFile ensures network sections and include directives select
+// the options which apply to each network, in order.
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conffile")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigFiles(t, dir, map[string]string{
+		"btcd.conf": "[Application Options]\n" +
+			"; comment\n" +
+			"maxpeers=10\n" +
+			"include=common.conf\n" +
+			"[regtest]\n" +
+			"addpeer=10.0.0.1\n" +
+			"include = regtest.conf\n" +
+			"[TestNet]\n" +
+			"addpeer=10.0.0.2\n" +
+			"[Application Options]\n" +
+			"debuglevel=debug\n",
+		"common.conf": "banduration=1h\n" +
+			"[testnet]\n" +
+			"listen=127.0.0.1\n",
+		"regtest.conf": "# comment\n" +
+			"rpclisten=127.0.0.1\n" +
+			"[simnet]\n" +
+			"listen=127.0.0.2\n",
+	})
+	path := filepath.Join(dir, "btcd.conf")
+
+	tests := []struct {
+		network string
+		want    []string
+	}{
+		{"", []string{"maxpeers", "banduration", "debuglevel"}},
+		{"mainnet", []string{"maxpeers", "banduration", "debuglevel"}},
+		{"regtest", []string{"maxpeers", "banduration", "addpeer",
+			"rpclisten", "debuglevel"}},
+		{"testnet", []string{"maxpeers", "banduration", "listen",
+			"addpeer", "debuglevel"}},
+		{"simnet", []string{"maxpeers", "banduration", "debuglevel"}},
+	}
+
+	for _, test := range tests {
+		entries, sectioned, err := readConfigFile(path, test.network)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.network, err)
+			continue
+		}
+		if !sectioned {
+			t.Errorf("%q: network sections not reported", test.network)
+		}
+		names := configEntryNames(entries)
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%q: unexpected options - got %v, want %v",
+				test.network, names, test.want)
+		}
+	}
+
+	// Entries refer to the file and line they were read from.
+	entries, _, err := readConfigFile(path, "regtest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.name != "rpclisten" {
+			continue
+		}
+		if entry.file != filepath.Join(dir, "regtest.conf") ||
+			entry.line != 2 || entry.text != "rpclisten=127.0.0.1" {
+
+			t.Errorf("unexpected entry %+v", entry)
+		}
+	}
+}
+
+// TestReadConfigFileErrors ensures missing and recursively included files are
+// reported.
+func TestReadConfigFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conffile")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigFiles(t, dir, map[string]string{
+		"a.conf":       "include=b.conf\n",
+		"b.conf":       "maxpeers=5\ninclude=a.conf\n",
+		"missing.conf": "include=nonexistent.conf\n",
+	})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.conf", "included recursively"},
+		{"missing.conf", "missing.conf:1:"},
+		{"nonexistent.conf", "nonexistent.conf"},
+	}
+
+	for _, test := range tests {
+		_, _, err := readConfigFile(filepath.Join(dir, test.name), "")
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: unexpected error - got %v, want %q",
+				test.name, err, test.want)
+		}
+	}
+}
+
+// TestReadNetworkConfigFile ensures config files without network sections are
+// skipped or filtered on the test networks as before sections existed.
+func TestReadNetworkConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conffile")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigFiles(t, dir, map[string]string{
+		"flat.conf": "maxpeers=10\naddpeer=10.0.0.1\n",
+		"sectioned.conf": "maxpeers=10\n[regtest]\naddpeer=10.0.0.1\n" +
+			"[simnet]\naddpeer=10.0.0.2\n",
+	})
+	flat := filepath.Join(dir, "flat.conf")
+	sectioned := filepath.Join(dir, "sectioned.conf")
+
+	tests := []struct {
+		name        string
+		file        string
+		defaultFile string
+		network     string
+		want        []string
+	}{
+		{
+			name:        "flat default file on regtest",
+			file:        flat,
+			defaultFile: flat,
+			network:     "regtest",
+		},
+		{
+			name:        "flat default file on simnet",
+			file:        flat,
+			defaultFile: flat,
+			network:     "simnet",
+		},
+		{
+			name:        "flat default file on testnet",
+			file:        flat,
+			defaultFile: flat,
+			network:     "testnet",
+			want:        []string{"maxpeers", "addpeer"},
+		},
+		{
+			name:    "flat specified file on regtest",
+			file:    flat,
+			network: "regtest",
+			want:    []string{"maxpeers"},
+		},
+		{
+			name:    "flat specified file on simnet",
+			file:    flat,
+			network: "simnet",
+			want:    []string{"maxpeers", "addpeer"},
+		},
+		{
+			name:        "missing default file on regtest",
+			file:        filepath.Join(dir, "missing.conf"),
+			defaultFile: filepath.Join(dir, "missing.conf"),
+			network:     "regtest",
+		},
+		{
+			name:        "sectioned default file on regtest",
+			file:        sectioned,
+			defaultFile: sectioned,
+			network:     "regtest",
+			want:        []string{"maxpeers", "addpeer"},
+		},
+		{
+			name:        "sectioned default file on simnet",
+			file:        sectioned,
+			defaultFile: sectioned,
+			network:     "simnet",
+			want:        []string{"maxpeers", "addpeer"},
+		},
+	}
+
+	savedDefault := defaultConfigFile
+	defer func() {
+		defaultConfigFile = savedDefault
+	}()
+	for _, test := range tests {
+		defaultConfigFile = test.defaultFile
+		preCfg := &config{}
+		preCfg.ConfigFile = test.file
+		preCfg.TestNet3 = test.network == "testnet"
+		preCfg.RegressionTest = test.network == "regtest"
+		preCfg.SimNet = test.network == "simnet"
+
+		entries, err := readNetworkConfigFile(preCfg, &serviceOptions{},
+			&envOptions{})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		names := configEntryNames(entries)
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s: unexpected options - got %v, want %v",
+				test.name, names, test.want)
+		}
+	}
+
+	// A missing file which was specified is reported.
+	preCfg := &config{}
+	preCfg.ConfigFile = filepath.Join(dir, "missing.conf")
+	preCfg.RegressionTest = true
+	_, err = readNetworkConfigFile(preCfg, &serviceOptions{}, &envOptions{})
+	if err == nil {
+		t.Errorf("missing specified file: unexpected success")
+	}
+}
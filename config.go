@@ -5,8 +5,10 @@
 package main
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
@@ -17,6 +19,8 @@ import (
 
 	flags "github.com/conformal/go-flags"
 	socks "github.com/conformal/go-socks"
+	"github.com/hlandauf/btcd/logformat"
+	"github.com/hlandauf/btcd/nmcnet"
 	"github.com/hlandauf/btcdb"
 	_ "github.com/hlandauf/btcdb/ldb"
 	_ "github.com/hlandauf/btcdb/memdb"
@@ -47,6 +51,12 @@ const (
 	blockMaxSizeMax          = btcwire.MaxBlockPayload - 1000
 	defaultBlockPrioritySize = 50000
 	defaultGenerate          = false
+	defaultProxyTimeout      = time.Second * 30
+	defaultShutdownTimeout   = time.Minute
+	defaultLogMaxSize        = 10
+	defaultLogMaxFiles       = 3
+	defaultLogFormat         = logformat.Text
+	blockDbNamePrefix        = "blocks"
 )
 
 var (
@@ -59,6 +69,54 @@ var (
 	defaultLogDir      = filepath.Join(btcdHomeDir, defaultLogDirname)
 )
 
+// config defines the configuration options for btcd.  The bulk of the
+// options are shared with the server and live in btcserver.Config, which is
+// embedded so its options are parsed as though they were declared here.  The
+// options declared directly on config only affect how btcd sets up the
+// server.
+//
+// See loadConfig for details on the configuration load process.
+type config struct {
+	btcserver.Config
+	TorIsolation    bool          `long:"torisolation" description:"Use random, unique proxy credentials for each connection and DNS lookup to enable Tor stream isolation"`
+	ProxyTimeout    time.Duration `long:"proxytimeout" description:"Maximum time to wait for a DNS lookup through the proxy to complete.  Valid time units are {s, m, h}"`
+	Resolver        string        `long:"resolver" description:"DNS resolver used for peer discovery {system, tor, doh:<url>, dns:<server>} -- The default is tor when a proxy is specified and system otherwise"`
+	TorControl      string        `long:"torcontrol" description:"Tor control port used to publish an onion service for incoming connections (eg. 127.0.0.1:9051)"`
+	TorControlPass  string        `long:"torcontrolpass" default-mask:"-" description:"Password for the Tor control port -- Cookie authentication is used if not specified"`
+	ProxyRoutes     []string      `long:"proxyroute" description:"Add a rule selecting how to reach matching destinations in the form <match>:<target> -- match is a CIDR network, a domain suffix such as *.onion or default, and target is direct, socks5://[user:pass@]host:port, http://[user:pass@]host:port or host:port"`
+	I2PSAM          string        `long:"i2psam" description:"I2P SAM v3 bridge used to connect to and accept connections from .i2p peers (eg. 127.0.0.1:7656)"`
+	LogMaxSize      int           `long:"logmaxsize" description:"Maximum size in megabytes of the log file before it is rotated"`
+	LogMaxFiles     int           `long:"logmaxfiles" description:"Maximum number of rotated log files to keep -- 0 keeps all of them"`
+	LogFormat       string        `long:"logformat" description:"Format of log output {text, json}"`
+	NetParams       string        `long:"netparams" description:"Use the custom network defined by the given JSON parameters file"`
+	CheckConfig     bool          `long:"checkconfig" description:"Validate the configuration, print the effective configuration with the source of each value and exit"`
+	ShutdownTimeout time.Duration `long:"shutdowntimeout" description:"Maximum time to wait for a graceful shutdown before aborting it -- 0 waits indefinitely.  Valid time units are {s, m, h}"`
+	CheckDB         int64         `long:"checkdb" description:"Check the given number of most recent blocks in the block database on startup, and roll back to the last good block if any of them are inconsistent -- 0 disables the check"`
+	RPCAuth         []string      `long:"rpcauth" default-mask:"-" description:"Add an RPC account in the form <user>:<password>:<permissions> -- The password may be a salted hash <salt>$<hash> as written by the rpcauth utility, and permissions are a + separated list of method names and the roles admin, readonly and mining"`
+	RPCClientCA     string        `long:"rpcclientca" description:"File containing the certificate authorities which sign RPC client certificates -- When specified, RPC clients must present a certificate whose subject common name is the name of an RPC account"`
+	RPCAutoCert     boolFlag      `long:"rpcautocert" optional:"yes" optional-value:"true" description:"Generate a self-signed RPC certificate pair on startup when neither the certificate nor the key file exists {true, false}"`
+
+	// i2p is the session through which .i2p peers are reached.  It is nil
+	// unless an I2P SAM bridge is specified.
+	i2p *i2pSession
+
+	// rpcAccounts contains the RPC accounts parsed from the rpcauth
+	// option.
+	rpcAccounts []*rpcAccount
+
+	// rpcClientCAs contains the certificate authorities read from the
+	// rpcclientca file.  It is nil unless the option is specified.
+	rpcClientCAs *x509.CertPool
+
+	// rpcGateway serves the RPC listeners while running.  It is nil when
+	// RPC is disabled.
+	rpcGateway *rpcGateway
+
+	// loaded contains the options as they were last parsed by readConfig.
+	// It is used to determine which options changed on reload.
+	loaded *config
+}
+
 // runServiceCommand is only set to a real function on Windows.  It is used
 // to parse and execute service commands specified via the -s flag.
 var runServiceCommand func(string) error
@@ -69,6 +127,21 @@ type serviceOptions struct {
 	ServiceCommand string `short:"s" long:"service" description:"Service command {install, remove, start, stop}"`
 }
 
+// boolFlag is a boolean option which takes an optional value, unlike a plain
+// bool option, so options which default to on can be turned off with
+// --option=false.
+type boolFlag bool
+
+// UnmarshalFlag satisfies the flags.Unmarshaler interface.
+func (b *boolFlag) UnmarshalFlag(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b = boolFlag(v)
+	return nil
+}
+
 // cleanAndExpandPath expands environment variables and leading ~ in the
 // passed path, cleans the result, and returns it.
 func cleanAndExpandPath(path string) string {
@@ -94,6 +167,40 @@ func validDbType(dbType string) bool {
 	return false
 }
 
+// blockDbPath returns the path of the block database of the passed type in the
+// passed data directory.
+func blockDbPath(dataDir, dbType string) string {
+	// The database name is based on the database type.
+	dbName := blockDbNamePrefix + "_" + dbType
+	if dbType == "sqlite" {
+		dbName = dbName + ".db"
+	}
+	return filepath.Join(dataDir, dbName)
+}
+
+// checkDbType returns an error when the passed data directory contains a block
+// database of a type other than the passed one, and none of that type.  Using
+// the configured type would otherwise silently start over with an empty
+// database.  The memdb type keeps blocks in memory only and never uses the
+// data directory, so it is always accepted.
+func checkDbType(dataDir, dbType string) error {
+	if dbType == "memdb" || fileExists(blockDbPath(dataDir, dbType)) {
+		return nil
+	}
+	for _, knownType := range knownDbTypes {
+		if knownType == dbType || knownType == "memdb" ||
+			!fileExists(blockDbPath(dataDir, knownType)) {
+			continue
+		}
+		return fmt.Errorf("the data directory %s contains a %s block "+
+			"database, but the database type is %s -- convert it "+
+			"with dbmigrate --srcdbtype=%s --dstdbtype=%s, or use "+
+			"--dbtype=%s", dataDir, knownType, dbType, knownType,
+			dbType, knownType)
+	}
+	return nil
+}
+
 // removeDuplicateAddresses returns a new slice with all duplicate entries in
 // addrs removed.
 func removeDuplicateAddresses(addrs []string) []string {
@@ -121,11 +228,12 @@ func normalizeAddress(addr, defaultPort string) string {
 // normalizeAddresses returns a new slice with all the passed peer addresses
 // normalized with the given default port, and all duplicates removed.
 func normalizeAddresses(addrs []string, defaultPort string) []string {
-	for i, addr := range addrs {
-		addrs[i] = normalizeAddress(addr, defaultPort)
+	normalized := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		normalized = append(normalized, normalizeAddress(addr, defaultPort))
 	}
 
-	return removeDuplicateAddresses(addrs)
+	return removeDuplicateAddresses(normalized)
 }
 
 // filesExists reports whether the named file or directory exists.
@@ -139,7 +247,7 @@ func fileExists(name string) bool {
 }
 
 // newConfigParser returns a new command line flags parser.
-func newConfigParser(cfg *btcserver.Config, so *serviceOptions, options flags.Options) *flags.Parser {
+func newConfigParser(cfg *config, so *serviceOptions, options flags.Options) *flags.Parser {
 	parser := flags.NewParser(cfg, options)
 	if runtime.GOOS == "windows" {
 		parser.AddGroup("Service Options", "Service Options", so)
@@ -168,6 +276,40 @@ func minUint32(a, b uint32) uint32 {
 	return b
 }
 
+// defaultConfig returns a config holding the default value of every option.
+func defaultConfig() config {
+	return config{
+		Config: btcserver.Config{
+			NodeConfig: btcnode.NodeConfig{
+				ConfigFile:        defaultConfigFile,
+				DebugLevel:        defaultLogLevel,
+				MaxPeers:          defaultMaxPeers,
+				BanDuration:       defaultBanDuration,
+				DataDir:           defaultDataDir,
+				LogDir:            defaultLogDir,
+				DbType:            defaultDbType,
+				FreeTxRelayLimit:  defaultFreeTxRelayLimit,
+				BlockMinSize:      defaultBlockMinSize,
+				BlockMaxSize:      defaultBlockMaxSize,
+				BlockPrioritySize: defaultBlockPrioritySize,
+				Generate:          defaultGenerate,
+			},
+			RPCConfig: btcmgmt.RPCServerConfig{
+				MaxClients:    defaultMaxRPCClients,
+				MaxWebsockets: defaultMaxRPCWebsockets,
+				Key:           defaultRPCKeyFile,
+				Cert:          defaultRPCCertFile,
+			},
+		},
+		ProxyTimeout:    defaultProxyTimeout,
+		ShutdownTimeout: defaultShutdownTimeout,
+		LogMaxSize:      defaultLogMaxSize,
+		LogMaxFiles:     defaultLogMaxFiles,
+		LogFormat:       defaultLogFormat,
+		RPCAutoCert:     true,
+	}
+}
+
 // loadConfig initializes and parses the config using a config file and command
 // line options.
 //
@@ -180,36 +322,7 @@ func minUint32(a, b uint32) uint32 {
 // The above results in btcd functioning properly without any config settings
 // while still allowing the user to override settings with config files and
 // command line options.  Command line options always take precedence.
-func loadConfig() (*btcserver.Config, []string, error) {
-	// Default config.
-	cfg := btcserver.Config{
-		NodeConfig: btcnode.NodeConfig{
-			ConfigFile:        defaultConfigFile,
-			DebugLevel:        defaultLogLevel,
-			MaxPeers:          defaultMaxPeers,
-			BanDuration:       defaultBanDuration,
-			DataDir:           defaultDataDir,
-			LogDir:            defaultLogDir,
-			DbType:            defaultDbType,
-			FreeTxRelayLimit:  defaultFreeTxRelayLimit,
-			BlockMinSize:      defaultBlockMinSize,
-			BlockMaxSize:      defaultBlockMaxSize,
-			BlockPrioritySize: defaultBlockPrioritySize,
-			Generate:          defaultGenerate,
-		},
-		RPCConfig: btcmgmt.RPCServerConfig{
-			MaxClients:    defaultMaxRPCClients,
-			MaxWebsockets: defaultMaxRPCWebsockets,
-			Key:           defaultRPCKeyFile,
-			Cert:          defaultRPCCertFile,
-		},
-	}
-
-	//cfg.initLogging()
-
-	// Service options which are only added on Windows.
-	serviceOpts := serviceOptions{}
-
+func loadConfig() (*config, []string, error) {
 	// Create the home directory if it doesn't already exist.
 	err := os.MkdirAll(btcdHomeDir, 0700)
 	if err != nil {
@@ -217,25 +330,22 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		return nil, nil, err
 	}
 
-	// Pre-parse the command line options to see if an alternative config
-	// file or the version flag was specified.  Any errors aside from the
-	// help message error can be ignored here since they will be caught by
-	// the final parse below.
-	preCfg := cfg
-	preParser := newConfigParser(&preCfg, &serviceOpts, flags.HelpFlag|flags.IgnoreUnknown)
-	_, err = preParser.Parse()
+	// Pre-parse the environment and command line options to see if an
+	// alternative config file or the version flag was specified.
+	p, err := preParseConfig()
 	if err != nil {
-		if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
-			fmt.Fprintln(os.Stderr, err)
-			return nil, nil, err
+		if e, ok := err.(*flags.Error); !ok || e.Type != flags.ErrHelp {
+			err = fmt.Errorf("loadConfig: %v", err)
 		}
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
 	}
 
 	// Show the version and exit if the version flag was specified.
 	appName := filepath.Base(os.Args[0])
 	appName = strings.TrimSuffix(appName, filepath.Ext(appName))
 	usageMessage := fmt.Sprintf("Use %s -h to show usage", appName)
-	if preCfg.ShowVersion {
+	if p.preCfg.ShowVersion {
 		fmt.Println(appName, "version", version())
 		os.Exit(0)
 	}
@@ -243,48 +353,49 @@ func loadConfig() (*btcserver.Config, []string, error) {
 	// Perform service command and exit if specified.  Invalid service
 	// commands show an appropriate error.  Only runs on Windows since
 	// the runServiceCommand function will be nil when not on Windows.
-	if serviceOpts.ServiceCommand != "" && runServiceCommand != nil {
-		err := runServiceCommand(serviceOpts.ServiceCommand)
+	if p.serviceOpts.ServiceCommand != "" && runServiceCommand != nil {
+		err := runServiceCommand(p.serviceOpts.ServiceCommand)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		}
 		os.Exit(0)
 	}
 
-	// Load additional config from file.
-	var configFileError error
-	parser := newConfigParser(&cfg, &serviceOpts, flags.Default|flags.IgnoreUnknown)
-	if !(preCfg.RegressionTest || preCfg.SimNet) || preCfg.ConfigFile !=
-		defaultConfigFile {
-
-		err := flags.NewIniParser(parser).ParseFile(preCfg.ConfigFile)
-		if err != nil {
-			if _, ok := err.(*os.PathError); !ok {
-				fmt.Fprintf(os.Stderr, "Error parsing config "+
-					"file: %v\n", err)
-				fmt.Fprintln(os.Stderr, usageMessage)
-				return nil, nil, err
-			}
-			configFileError = err
-		}
-	}
-
-	// Don't add peers from the config file when in regression test mode.
-	if preCfg.RegressionTest && len(cfg.AddPeers) > 0 {
-		cfg.AddPeers = nil
-	}
-
-	// Parse command line options again to ensure they take precedence.
-	remainingArgs, err := parser.Parse()
+	// Load additional config from file, and then parse the environment
+	// and command line options again to ensure they take precedence.
+	remainingArgs, err := p.parse(flags.Default | flags.IgnoreUnknown)
 	if err != nil {
+		if _, ok := err.(*flags.Error); !ok {
+			fmt.Fprintln(os.Stderr, err)
+		}
 		if e, ok := err.(*flags.Error); !ok || e.Type != flags.ErrHelp {
 			fmt.Fprintln(os.Stderr, usageMessage)
 		}
 		return nil, nil, err
 	}
 
-	// Multiple networks can't be selected simultaneously.
+	// Keep the options as they were parsed, before being validated and
+	// adjusted below, to find those which change when reloading.
+	cfg := p.cfg
+	loaded := p.cfg
+	cfg.loaded = &loaded
+
+	// Report each problem found while validating the options below.  In
+	// --checkconfig mode all of them are collected and reported together
+	// rather than stopping at the first one.
 	funcName := "loadConfig"
+	var configErrs []error
+	configError := func(err error) bool {
+		fmt.Fprintln(os.Stderr, err)
+		if cfg.CheckConfig {
+			configErrs = append(configErrs, err)
+			return false
+		}
+		fmt.Fprintln(os.Stderr, usageMessage)
+		return true
+	}
+
+	// Multiple networks can't be selected simultaneously.
 	numNets := 0
 	// Count number of network flags passed; assign active network params
 	// while we're at it
@@ -292,11 +403,11 @@ func loadConfig() (*btcserver.Config, []string, error) {
 
 	if cfg.TestNet3 {
 		numNets++
-		cfg.ActiveNetParams = &btcnet.TestNet3Params
+		cfg.ActiveNetParams = &nmcnet.TestNetParams
 	}
 	if cfg.RegressionTest {
 		numNets++
-		cfg.ActiveNetParams = &btcnet.RegressionNetParams
+		cfg.ActiveNetParams = &nmcnet.RegressionNetParams
 	}
 	if cfg.SimNet {
 		numNets++
@@ -304,13 +415,27 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		cfg.ActiveNetParams = &btcnet.SimNetParams
 		cfg.DisableDNSSeed = true
 	}
+	if cfg.NetParams != "" {
+		numNets++
+		cfg.NetParams = cleanAndExpandPath(cfg.NetParams)
+		params, err := nmcnet.LoadParamsFile(cfg.NetParams)
+		if err != nil {
+			str := "%s: Unable to load network parameters from %s: %v"
+			err := fmt.Errorf(str, funcName, cfg.NetParams, err)
+			if configError(err) {
+				return nil, nil, err
+			}
+		} else {
+			cfg.ActiveNetParams = params
+		}
+	}
 	if numNets > 1 {
-		str := "%s: The testnet, regtest, and simnet params can't be " +
-			"used together -- choose one of the three"
+		str := "%s: The testnet, regtest, simnet, and netparams options " +
+			"can't be used together -- choose one of the four"
 		err := fmt.Errorf(str, funcName)
-		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, usageMessage)
-		return nil, nil, err
+		if configError(err) {
+			return nil, nil, err
+		}
 	}
 
 	// Append the network type to the data directory so it is "namespaced"
@@ -328,31 +453,86 @@ func loadConfig() (*btcserver.Config, []string, error) {
 	cfg.LogDir = filepath.Join(cfg.LogDir, netName(cfg.ActiveNetParams))
 
 	// Special show command to list supported subsystems and exit.
-	/*if cfg.DebugLevel == "show" {
-		fmt.Println("Supported subsystems", cfg.supportedSubsystems())
+	if cfg.DebugLevel == "show" {
+		fmt.Println("Supported subsystems", supportedSubsystems())
 		os.Exit(0)
-	}*/
+	}
+
+	// Validate the log rotation settings.
+	if cfg.LogMaxSize <= 0 {
+		str := "%s: The logmaxsize option must be greater than 0 -- " +
+			"parsed [%d]"
+		err := fmt.Errorf(str, funcName, cfg.LogMaxSize)
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+	if cfg.LogMaxFiles < 0 {
+		str := "%s: The logmaxfiles option may not be negative -- " +
+			"parsed [%d]"
+		err := fmt.Errorf(str, funcName, cfg.LogMaxFiles)
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
 
-	// Initialize logging at the default logging level.
-	//cfg.initSeelogLogger(filepath.Join(cfg.LogDir, defaultLogFilename))
-	//cfg.setLogLevels(defaultLogLevel)
+	// Validate and select the log format.
+	if err := logformat.SetFormat(cfg.LogFormat); err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+
+	// Initialize logging at the default logging level.  No log file is
+	// written when only checking the configuration.
+	if !cfg.CheckConfig {
+		err = initLogRotator(filepath.Join(cfg.LogDir,
+			defaultLogFilename), cfg.LogMaxSize, cfg.LogMaxFiles)
+		if err != nil {
+			str := "%s: Unable to open log file: %v"
+			err := fmt.Errorf(str, funcName, err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+	setLogLevels(defaultLogLevel)
 
 	// Parse, validate, and set debug log level(s).
-	/*if err := cfg.parseAndSetDebugLevels(cfg.DebugLevel); err != nil {
+	if err := parseAndSetDebugLevels(cfg.DebugLevel); err != nil {
 		err := fmt.Errorf("%s: %v", funcName, err.Error())
-		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, usageMessage)
-		return nil, nil, err
-	}*/
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
 
 	// Validate database type.
 	if !validDbType(cfg.DbType) {
 		str := "%s: The specified database type [%v] is invalid -- " +
 			"supported types %v"
 		err := fmt.Errorf(str, funcName, cfg.DbType, knownDbTypes)
-		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, usageMessage)
-		return nil, nil, err
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+
+	// Don't use a data directory holding a block database of another type.
+	if validDbType(cfg.DbType) {
+		if err := checkDbType(cfg.DataDir, cfg.DbType); err != nil {
+			err := fmt.Errorf("%s: %v", funcName, err)
+			if configError(err) {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// The number of blocks to check can't be negative.
+	if cfg.CheckDB < 0 {
+		str := "%s: The checkdb option may not be negative -- parsed [%d]"
+		err := fmt.Errorf(str, funcName, cfg.CheckDB)
+		if configError(err) {
+			return nil, nil, err
+		}
 	}
 
 	// Validate profile port number
@@ -361,9 +541,9 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		if err != nil || profilePort < 1024 || profilePort > 65535 {
 			str := "%s: The profile port must be between 1024 and 65535"
 			err := fmt.Errorf(str, funcName)
-			fmt.Fprintln(os.Stderr, err)
-			fmt.Fprintln(os.Stderr, usageMessage)
-			return nil, nil, err
+			if configError(err) {
+				return nil, nil, err
+			}
 		}
 	}
 
@@ -371,9 +551,9 @@ func loadConfig() (*btcserver.Config, []string, error) {
 	if cfg.BanDuration < time.Duration(time.Second) {
 		str := "%s: The banduration option may not be less than 1s -- parsed [%v]"
 		err := fmt.Errorf(str, funcName, cfg.BanDuration)
-		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, usageMessage)
-		return nil, nil, err
+		if configError(err) {
+			return nil, nil, err
+		}
 	}
 
 	// --addPeer and --connect do not mix.
@@ -381,9 +561,40 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		str := "%s: the --addpeer and --connect options can not be " +
 			"mixed"
 		err := fmt.Errorf(str, funcName)
-		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, usageMessage)
-		return nil, nil, err
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+
+	// Don't allow proxy timeouts which would fail every lookup.
+	if cfg.ProxyTimeout <= 0 {
+		str := "%s: The proxytimeout option must be positive -- parsed [%v]"
+		err := fmt.Errorf(str, funcName, cfg.ProxyTimeout)
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+
+	// A negative shutdown timeout would abort every shutdown.
+	if cfg.ShutdownTimeout < 0 {
+		str := "%s: The shutdowntimeout option may not be negative " +
+			"-- parsed [%v]"
+		err := fmt.Errorf(str, funcName, cfg.ShutdownTimeout)
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+
+	// Tor stream isolation only makes sense when a SOCKS5 proxy is in use.
+	if cfg.TorIsolation && (cfg.Proxy == "" || isHTTPProxy(cfg.Proxy)) &&
+		cfg.OnionProxy == "" {
+
+		str := "%s: the --torisolation option requires --proxy to be " +
+			"a SOCKS5 proxy or --onion to be set"
+		err := fmt.Errorf(str, funcName)
+		if configError(err) {
+			return nil, nil, err
+		}
 	}
 
 	// --proxy or --connect without --listen disables listening.
@@ -392,6 +603,17 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		cfg.DisableListen = true
 	}
 
+	// An onion service can only be published for a listening node.
+	if cfg.TorControl != "" && cfg.DisableListen {
+		str := "%s: the --torcontrol option requires listening for " +
+			"incoming connections -- specify listen interfaces via " +
+			"--listen"
+		err := fmt.Errorf(str, funcName)
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+
 	// Connect means no DNS seeding.
 	if len(cfg.ConnectPeers) > 0 {
 		cfg.DisableDNSSeed = true
@@ -406,16 +628,62 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		}
 	}
 
-	// The RPC server is disabled if no username or password is provided.
-	if cfg.RPCConfig.User == "" || cfg.RPCConfig.Pass == "" {
+	// The RPC server uses cookie authentication if neither a username nor
+	// a password is provided, and is disabled if only one of them is.
+	if (cfg.RPCConfig.User == "") != (cfg.RPCConfig.Pass == "") {
+		log.Warnf("RPC server disabled -- both rpcuser and rpcpass " +
+			"must be specified")
 		cfg.DisableRPC = true
 	}
 
+	// Parse the additional RPC accounts.  Account names must differ from
+	// rpcuser, or the cookie user when there is none.
+	adminUser := cfg.RPCConfig.User
+	if adminUser == "" {
+		adminUser = rpcCookieUser
+	}
+	accounts, errs := parseRPCAccounts(cfg.RPCAuth, adminUser)
+	for _, err := range errs {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		if configError(err) {
+			return nil, nil, err
+		}
+	}
+	cfg.rpcAccounts = accounts
+
+	// Read the certificate authorities used to verify RPC client
+	// certificates.
+	if cfg.RPCClientCA != "" && !cfg.DisableRPC {
+		cfg.RPCClientCA = cleanAndExpandPath(cfg.RPCClientCA)
+		pem, err := ioutil.ReadFile(cfg.RPCClientCA)
+		if err != nil {
+			str := "%s: unable to read rpcclientca file: %v"
+			err := fmt.Errorf(str, funcName, err)
+			if configError(err) {
+				return nil, nil, err
+			}
+		} else {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				str := "%s: the rpcclientca file %s contains no " +
+					"certificates"
+				err := fmt.Errorf(str, funcName, cfg.RPCClientCA)
+				if configError(err) {
+					return nil, nil, err
+				}
+			} else {
+				cfg.rpcClientCAs = pool
+			}
+		}
+	}
+
 	// Default RPC to listen on localhost only.
 	if !cfg.DisableRPC && len(cfg.RPCConfig.Listeners) == 0 {
 		addrs, err := net.LookupHost("localhost")
 		if err != nil {
-			return nil, nil, err
+			if configError(err) {
+				return nil, nil, err
+			}
 		}
 		cfg.RPCConfig.Listeners = make([]string, 0, len(addrs))
 		for _, addr := range addrs {
@@ -433,9 +701,9 @@ func loadConfig() (*btcserver.Config, []string, error) {
 			"and %d -- parsed [%d]"
 		err := fmt.Errorf(str, funcName, blockMaxSizeMin,
 			blockMaxSizeMax, cfg.BlockMaxSize)
-		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, usageMessage)
-		return nil, nil, err
+		if configError(err) {
+			return nil, nil, err
+		}
 	}
 
 	// Limit the block priority and minimum block sizes to max block size.
@@ -451,16 +719,18 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		if err != nil {
 			str := "%s: getworkkey '%s' failed to decode: %v"
 			err := fmt.Errorf(str, funcName, strAddr, err)
-			fmt.Fprintln(os.Stderr, err)
-			fmt.Fprintln(os.Stderr, usageMessage)
-			return nil, nil, err
+			if configError(err) {
+				return nil, nil, err
+			}
+			continue
 		}
 		if !addr.IsForNet(cfg.ActiveNetParams) {
 			str := "%s: getworkkey '%s' is on the wrong network"
 			err := fmt.Errorf(str, funcName, strAddr)
-			fmt.Fprintln(os.Stderr, err)
-			fmt.Fprintln(os.Stderr, usageMessage)
-			return nil, nil, err
+			if configError(err) {
+				return nil, nil, err
+			}
+			continue
 		}
 		cfg.MiningAddrsS = append(cfg.MiningAddrsS, addr)
 	}
@@ -471,16 +741,18 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		if err != nil {
 			str := "%s: mining address '%s' failed to decode: %v"
 			err := fmt.Errorf(str, funcName, strAddr, err)
-			fmt.Fprintln(os.Stderr, err)
-			fmt.Fprintln(os.Stderr, usageMessage)
-			return nil, nil, err
+			if configError(err) {
+				return nil, nil, err
+			}
+			continue
 		}
 		if !addr.IsForNet(cfg.ActiveNetParams) {
 			str := "%s: mining address '%s' is on the wrong network"
 			err := fmt.Errorf(str, funcName, strAddr)
-			fmt.Fprintln(os.Stderr, err)
-			fmt.Fprintln(os.Stderr, usageMessage)
-			return nil, nil, err
+			if configError(err) {
+				return nil, nil, err
+			}
+			continue
 		}
 		cfg.MiningAddrsS = append(cfg.MiningAddrsS, addr)
 	}
@@ -491,9 +763,9 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		str := "%s: the generate flag is set, but there are no mining " +
 			"addresses specified "
 		err := fmt.Errorf(str, funcName)
-		fmt.Fprintln(os.Stderr, err)
-		fmt.Fprintln(os.Stderr, usageMessage)
-		return nil, nil, err
+		if configError(err) {
+			return nil, nil, err
+		}
 	}
 
 	// Add default port to all listener addresses if needed and remove
@@ -518,20 +790,73 @@ func loadConfig() (*btcserver.Config, []string, error) {
 	// function as well as the system DNS resolver.  When a proxy is
 	// specified, the dial function is set to the proxy specific dial
 	// function and the lookup is set to use tor (unless --noonion is
-	// specified in which case the system DNS resolver is used).
+	// specified in which case the system DNS resolver is used).  With
+	// --torisolation, every dial and lookup through a proxy uses its own
+	// random credentials so Tor places it on a separate circuit.  HTTP
+	// proxies are used for dialing only, since they can't resolve names on
+	// our behalf, so the system DNS resolver is used with them.
 	cfg.Dial = net.Dial
 	cfg.Lookup = net.LookupIP
-	if cfg.Proxy != "" {
-		proxy := &socks.Proxy{
+	if isHTTPProxy(cfg.Proxy) {
+		proxy, err := newHTTPProxy(cfg.Proxy, cfg.ProxyUser,
+			cfg.ProxyPass)
+		if err != nil {
+			err := fmt.Errorf("%s: invalid proxy [%v]: %v", funcName,
+				redactURLPassword(cfg.Proxy), err)
+			if configError(err) {
+				return nil, nil, err
+			}
+		} else {
+			cfg.Dial = proxy.Dial
+		}
+	} else if cfg.Proxy != "" {
+		if cfg.TorIsolation && (cfg.ProxyUser != "" || cfg.ProxyPass != "") {
+			log.Warnf("Tor isolation set -- overriding specified " +
+				"proxy user credentials")
+		}
+		proxy := newTorProxy(&socks.Proxy{
 			Addr:     cfg.Proxy,
 			Username: cfg.ProxyUser,
 			Password: cfg.ProxyPass,
-		}
+		}, cfg.TorIsolation)
 		cfg.Dial = proxy.Dial
 		if !cfg.NoOnion {
-			cfg.Lookup = func(host string) ([]net.IP, error) {
-				return torLookupIP(host, cfg.Proxy)
+			cfg.Lookup = newTorResolver(proxy, cfg.ProxyTimeout).LookupIP
+		}
+	}
+
+	// Override the DNS resolution (lookup) function selected above when a
+	// resolver is explicitly specified.  This is done after the dial
+	// function is selected since some resolvers connect to their servers
+	// through it.
+	if cfg.Resolver != "" {
+		lookup, err := newLookup(&cfg, cfg.Resolver)
+		if err != nil {
+			err := fmt.Errorf("%s: invalid resolver [%v]: %v", funcName,
+				cfg.Resolver, err)
+			if configError(err) {
+				return nil, nil, err
+			}
+		} else {
+			cfg.Lookup = lookup
+		}
+	}
+
+	// Route dials and lookups according to the proxy routing rules when
+	// any are specified.  Destinations which are not matched by any rule,
+	// and there is no default rule for, continue to use the dial and lookup
+	// functions selected above.
+	if len(cfg.ProxyRoutes) > 0 {
+		router, err := newProxyRouter(&cfg, cfg.ProxyRoutes, cfg.Dial,
+			cfg.Lookup)
+		if err != nil {
+			err := fmt.Errorf("%s: %v", funcName, err)
+			if configError(err) {
+				return nil, nil, err
 			}
+		} else {
+			cfg.Dial = router.Dial
+			cfg.Lookup = router.LookupIP
 		}
 	}
 
@@ -544,22 +869,37 @@ func loadConfig() (*btcserver.Config, []string, error) {
 	// This allows .onion address traffic to be routed through a different
 	// proxy than normal traffic.
 	if cfg.OnionProxy != "" {
-		cfg.Oniondial = func(a, b string) (net.Conn, error) {
-			proxy := &socks.Proxy{
-				Addr:     cfg.OnionProxy,
-				Username: cfg.OnionProxyUser,
-				Password: cfg.OnionProxyPass,
-			}
-			return proxy.Dial(a, b)
-		}
-		cfg.Onionlookup = func(host string) ([]net.IP, error) {
-			return torLookupIP(host, cfg.OnionProxy)
+		if cfg.TorIsolation &&
+			(cfg.OnionProxyUser != "" || cfg.OnionProxyPass != "") {
+			log.Warnf("Tor isolation set -- overriding specified " +
+				"onion proxy user credentials")
 		}
+		onionProxy := newTorProxy(&socks.Proxy{
+			Addr:     cfg.OnionProxy,
+			Username: cfg.OnionProxyUser,
+			Password: cfg.OnionProxyPass,
+		}, cfg.TorIsolation)
+		cfg.Oniondial = onionProxy.Dial
+		cfg.Onionlookup = newTorResolver(onionProxy,
+			cfg.ProxyTimeout).LookupIP
 	} else {
 		cfg.Oniondial = cfg.Dial
 		cfg.Onionlookup = cfg.Lookup
 	}
 
+	// Setup the I2P dial and DNS resolution (lookup) functions when an I2P
+	// SAM bridge is specified.  Much like .onion addresses are routed
+	// through the onion-specific functions, .i2p addresses are routed
+	// through the SAM bridge while all other traffic uses the dial and
+	// lookup functions selected above.  I2P hostnames don't map to IP
+	// addresses, so looking them up returns an address in 127.128.0.0/9
+	// which the session maps back to the destination when it is dialed.
+	if cfg.I2PSAM != "" {
+		cfg.i2p = newI2PSession(cfg.I2PSAM,
+			filepath.Join(cfg.DataDir, i2pKeyFilename))
+		cfg.Dial, cfg.Lookup = i2pRoutes(cfg.i2p, cfg.Dial, cfg.Lookup)
+	}
+
 	// Specifying --noonion means the onion address dial and DNS resolution
 	// (lookup) functions result in an error.
 	if cfg.NoOnion {
@@ -571,12 +911,121 @@ func loadConfig() (*btcserver.Config, []string, error) {
 		}
 	}
 
+	// Print the effective configuration along with where each value came
+	// from, and report whether any problems were found, when only checking
+	// the configuration.
+	if cfg.CheckConfig {
+		sources := configSources(&cfg, p.fileOptions, os.Args[1:])
+		writeEffectiveConfig(os.Stdout, &cfg, sources)
+		if len(configErrs) > 0 {
+			str := "%s: %d problem(s) found in the configuration"
+			err := fmt.Errorf(str, funcName, len(configErrs))
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		fmt.Println("Configuration OK")
+	}
+
 	// Warn about missing config file only after all other configuration is
 	// done.  This prevents the warning on help messages and invalid
 	// options.  Note this should go directly before the return.
-	if configFileError != nil {
-		log.Warnf("%v", configFileError)
+	if p.configFileError != nil {
+		log.Warnf("%v", p.configFileError)
+	}
+	for _, name := range p.env.unknown {
+		log.Warnf("Ignoring environment variable %s which does not "+
+			"match any option", name)
 	}
 
 	return &cfg, remainingArgs, nil
 }
+
+// configParse holds the state of parsing the options set through environment
+// variables, the config file and the command line.  Both loadConfig and
+// readConfig parse them with preParseConfig followed by parse, so the options
+// are read the same way on startup and on reload.
+type configParse struct {
+	env         *envOptions
+	preCfg      config
+	serviceOpts serviceOptions
+
+	// cfg holds the parsed options once parse returns.
+	cfg config
+
+	// fileOptions contains the names of the options set by the config
+	// file, and configFileError the error reading it when it is missing.
+	fileOptions     []string
+	configFileError error
+}
+
+// preParseConfig collects the options set through environment variables and
+// pre-parses them along with the command line options to find the config
+// file, the network and the options which are acted on before the config file
+// is read.  Errors other than the help message are ignored here since they
+// are caught by parse.
+func preParseConfig() (*configParse, error) {
+	p := &configParse{cfg: defaultConfig()}
+	env, err := envArgs(&p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.env = env
+
+	p.preCfg = p.cfg
+	preParser := newConfigParser(&p.preCfg, &p.serviceOpts,
+		flags.HelpFlag|flags.IgnoreUnknown)
+	p.env.parse(preParser, &p.preCfg)
+	_, err = preParser.Parse()
+	if e, ok := err.(*flags.Error); ok && e.Type == flags.ErrHelp {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parse parses the options set through the config file, environment variables
+// and the command line, in order of increasing precedence, into the config of
+// the parse, which starts out holding the defaults.  The remaining command
+// line arguments are returned.  A missing config file is not an error, but is
+// kept in configFileError.  Errors of the config file and the environment
+// variables say where they come from, while those of the command line are
+// returned by the parser as they are.
+func (p *configParse) parse(options flags.Options) ([]string, error) {
+	parser := newConfigParser(&p.cfg, &p.serviceOpts, options)
+	entries, err := readNetworkConfigFile(&p.preCfg, &p.serviceOpts, p.env)
+	if err == nil {
+		err = parseConfigEntries(parser, entries)
+	}
+	if err != nil {
+		if _, ok := err.(*os.PathError); !ok {
+			return nil, fmt.Errorf("Error parsing config file: %v",
+				err)
+		}
+		p.configFileError = err
+	}
+	for _, entry := range entries {
+		p.fileOptions = append(p.fileOptions, entry.name)
+	}
+
+	if err := p.env.parse(parser, &p.cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing environment variables: %v",
+			err)
+	}
+	return parser.Parse()
+}
+
+// readConfig parses the options set through environment variables, the config
+// file and the command line as loadConfig does, into a new config holding the
+// defaults.  Unlike loadConfig, it neither validates the options nor acts on
+// any of them, and it reports errors instead of printing them, so it is safe to
+// call while running to reload the configuration.  A missing config file is not
+// an error.
+func readConfig() (*config, error) {
+	p, err := preParseConfig()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.parse(flags.PassDoubleDash | flags.IgnoreUnknown); err != nil {
+		return nil, err
+	}
+	return &p.cfg, nil
+}
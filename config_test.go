@@ -0,0 +1,114 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestCheckDbType ensures btcd refuses to start over with an empty block
+// database when the data directory holds one of another type, except for the
+// in-memory database type.
+func TestCheckDbType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbtype")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	empty, err := ioutil.TempDir("", "dbtype")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(empty)
+	if err := os.Mkdir(blockDbPath(dir, "leveldb"), 0700); err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+
+	savedTypes := knownDbTypes
+	defer func() {
+		knownDbTypes = savedTypes
+	}()
+	knownDbTypes = []string{"leveldb", "sqlite", "memdb"}
+
+	tests := []struct {
+		dataDir string
+		dbType  string
+		err     bool
+	}{
+		{dir, "leveldb", false},
+		{dir, "sqlite", true},
+		{dir, "memdb", false},
+		{empty, "leveldb", false},
+		{empty, "sqlite", false},
+	}
+
+	for _, test := range tests {
+		err := checkDbType(test.dataDir, test.dbType)
+		if (err != nil) != test.err {
+			t.Errorf("checkDbType(%s, %s): unexpected error - got "+
+				"%v, want error %v", test.dataDir, test.dbType,
+				err, test.err)
+		}
+	}
+}
+
+// TestReadConfig ensures the options set through the config file, environment
+// variables and the command line are parsed in order of increasing precedence.
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "btcd.conf")
+	err = ioutil.WriteFile(configFile, []byte("maxpeers=5\nbanduration=1h\n"+
+		"nolisten=1\naddpeer=10.0.0.1\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	savedArgs := os.Args
+	defer func() {
+		os.Args = savedArgs
+	}()
+	os.Args = []string{"btcd", "--configfile=" + configFile, "--maxpeers=9"}
+	restore := setTestEnv(map[string]string{
+		"BTCD_BANDURATION": "2h",
+		"BTCD_MAXPEERS":    "7",
+		"BTCD_NOLISTEN":    "false",
+	})
+	cfg, err := readConfig()
+	restore()
+	if err != nil {
+		t.Fatalf("readConfig: unexpected error: %v", err)
+	}
+	if cfg.MaxPeers != 9 || cfg.BanDuration != 2*time.Hour ||
+		cfg.DisableListen || !reflect.DeepEqual(cfg.AddPeers,
+		[]string{"10.0.0.1"}) {
+
+		t.Errorf("readConfig: unexpected options - maxpeers %d, "+
+			"banduration %v, nolisten %v, addpeer %v", cfg.MaxPeers,
+			cfg.BanDuration, cfg.DisableListen, cfg.AddPeers)
+	}
+}
+
+// TestNormalizeAddresses ensures addresses are normalized into a new slice
+// without duplicates, leaving the passed one untouched.
+func TestNormalizeAddresses(t *testing.T) {
+	addrs := []string{"10.0.0.1", "10.0.0.1:8333", "[::1]:18333"}
+	got := normalizeAddresses(addrs, "8333")
+	want := []string{"10.0.0.1:8333", "[::1]:18333"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected addresses - got %v, want %v", got, want)
+	}
+	if addrs[0] != "10.0.0.1" {
+		t.Errorf("passed addresses were modified: %v", addrs)
+	}
+}
@@ -5,9 +5,16 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"io"
 	"net"
+	"time"
+
+	socks "github.com/conformal/go-socks"
 )
 
 const (
@@ -22,10 +29,33 @@ const (
 	torAddrNotSupported  = 0x08
 )
 
+// SOCKS5 commands which are Tor extensions to the protocol.  They are
+// documented in the Tor socks-extensions specification.
+const (
+	torCmdResolve    = 0xF0
+	torCmdResolvePTR = 0xF1
+)
+
+// SOCKS5 authentication methods as defined by RFC 1928.
+const (
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+)
+
+// SOCKS5 address types as defined by RFC 1928.
+const (
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+)
+
 var (
 	ErrTorInvalidAddressResponse = errors.New("invalid address response")
 	ErrTorInvalidProxyResponse   = errors.New("invalid proxy response")
 	ErrTorUnrecognizedAuthMethod = errors.New("invalid proxy authentication method")
+	ErrTorHostnameTooLong        = errors.New("hostname too long for tor resolve")
+	ErrTorCredentialsTooLong     = errors.New("proxy username or password too long")
+	ErrTorAuthFailed             = errors.New("proxy authentication failed")
 
 	torStatusErrors = map[byte]error{
 		torSucceeded:         errors.New("tor succeeded"),
@@ -40,85 +70,323 @@ var (
 	}
 )
 
-// torLookupIP uses Tor to resolve DNS via the SOCKS extension they provide for
-// resolution over the Tor network. Tor itself doesnt support ipv6 so this
-// doesn't either.
-func torLookupIP(host, proxy string) ([]net.IP, error) {
-	conn, err := net.Dial("tcp", proxy)
+// torAuthenticate performs the SOCKS5 method negotiation on the passed
+// connection.  Username/password authentication as defined by RFC 1929 is
+// used when the proxy has credentials configured so that the same credentials
+// used for dialing are also used for resolution.
+func torAuthenticate(conn net.Conn, proxy *socks.Proxy) error {
+	method := byte(socksAuthNone)
+	if proxy.Username != "" || proxy.Password != "" {
+		method = socksAuthPassword
+	}
+
+	_, err := conn.Write([]byte{'\x05', '\x01', method})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer conn.Close()
 
-	buf := []byte{'\x05', '\x01', '\x00'}
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if buf[0] != '\x05' {
+		return ErrTorInvalidProxyResponse
+	}
+	if buf[1] != method {
+		return ErrTorUnrecognizedAuthMethod
+	}
+	if method == socksAuthNone {
+		return nil
+	}
+
+	if len(proxy.Username) > 255 || len(proxy.Password) > 255 {
+		return ErrTorCredentialsTooLong
+	}
+	buf = make([]byte, 0, 3+len(proxy.Username)+len(proxy.Password))
+	buf = append(buf, 1) // subnegotiation version
+	buf = append(buf, byte(len(proxy.Username)))
+	buf = append(buf, proxy.Username...)
+	buf = append(buf, byte(len(proxy.Password)))
+	buf = append(buf, proxy.Password...)
 	_, err = conn.Write(buf)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	buf = make([]byte, 2)
-	_, err = conn.Read(buf)
+	_, err = io.ReadFull(conn, buf)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if buf[0] != '\x05' {
-		return nil, ErrTorInvalidProxyResponse
+	if buf[0] != 1 {
+		return ErrTorInvalidProxyResponse
+	}
+	if buf[1] != 0 {
+		return ErrTorAuthFailed
 	}
-	if buf[1] != '\x00' {
-		return nil, ErrTorUnrecognizedAuthMethod
+
+	return nil
+}
+
+// torResolve connects to the passed Tor SOCKS5 proxy, issues the given
+// resolve command for the passed address and returns the address type and raw
+// address of the reply.  The deadline of the passed context, if any, bounds
+// both the dial and all reads and writes, and canceling the context aborts any
+// operation which is in progress.
+func torResolve(ctx context.Context, proxy *socks.Proxy, cmd, atyp byte, addr []byte) (byte, []byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Addr)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
 
-	buf = make([]byte, 7+len(host))
-	buf[0] = 5      // protocol version
-	buf[1] = '\xF0' // Tor Resolve
-	buf[2] = 0      // reserved
-	buf[3] = 3      // Tor Resolve
-	buf[4] = byte(len(host))
-	copy(buf[5:], host)
-	buf[5+len(host)] = 0 // Port 0
+	// Unblock any pending read or write as soon as the context is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	replyAtyp, replyAddr, err := torResolveConn(conn, proxy, cmd, atyp, addr)
+	if err != nil {
+		// Report the cancellation or expired deadline rather than the
+		// resulting I/O error.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, nil, ctxErr
+		}
+		return 0, nil, err
+	}
+
+	return replyAtyp, replyAddr, nil
+}
+
+// torResolveConn performs the resolve request for torResolve over the passed
+// connection to the proxy.
+func torResolveConn(conn net.Conn, proxy *socks.Proxy, cmd, atyp byte, addr []byte) (byte, []byte, error) {
+	err := torAuthenticate(conn, proxy)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Domain names are prefixed with their length.
+	if atyp == socksAtypDomain {
+		if len(addr) > 255 {
+			return 0, nil, ErrTorHostnameTooLong
+		}
+		addr = append([]byte{byte(len(addr))}, addr...)
+	}
+
+	buf := make([]byte, 6+len(addr))
+	buf[0] = 5    // protocol version
+	buf[1] = cmd  // Tor Resolve or Resolve PTR
+	buf[2] = 0    // reserved
+	buf[3] = atyp // address type
+	copy(buf[4:], addr)
+	// Port 0 (the last two bytes) is already zeroed.
 
 	_, err = conn.Write(buf)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
 	buf = make([]byte, 4)
-	_, err = conn.Read(buf)
+	_, err = io.ReadFull(conn, buf)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	if buf[0] != 5 {
-		return nil, ErrTorInvalidProxyResponse
+		return 0, nil, ErrTorInvalidProxyResponse
 	}
 	if buf[1] != 0 {
-		if int(buf[1]) > len(torStatusErrors) {
+		err, ok := torStatusErrors[buf[1]]
+		if !ok {
 			err = ErrTorInvalidProxyResponse
-		} else {
-			err := torStatusErrors[buf[1]]
-			if err == nil {
-				err = ErrTorInvalidProxyResponse
-			}
 		}
-		return nil, err
+		return 0, nil, err
 	}
-	if buf[3] != 1 {
-		err := torStatusErrors[torGeneralError]
+
+	var addrLen int
+	replyAtyp := buf[3]
+	switch replyAtyp {
+	case socksAtypIPv4:
+		addrLen = net.IPv4len
+	case socksAtypIPv6:
+		addrLen = net.IPv6len
+	case socksAtypDomain:
+		buf = make([]byte, 1)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		addrLen = int(buf[0])
+	default:
+		return 0, nil, ErrTorInvalidAddressResponse
+	}
+
+	// Read the bound address along with the two byte port which follows
+	// it.  The port carries no meaning for resolve requests.
+	buf = make([]byte, addrLen+2)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return replyAtyp, buf[:addrLen], nil
+}
+
+// torLookupIP uses Tor to resolve DNS via the SOCKS extension they provide for
+// resolution over the Tor network.  Both IPv4 and IPv6 replies are supported.
+// The credentials of the passed proxy, if any, are used to authenticate.
+func torLookupIP(ctx context.Context, host string, proxy *socks.Proxy) ([]net.IP, error) {
+	atyp, addr, err := torResolve(ctx, proxy, torCmdResolve,
+		socksAtypDomain, []byte(host))
+	if err != nil {
 		return nil, err
 	}
 
-	buf = make([]byte, 4)
-	bytes, err := conn.Read(buf)
+	switch atyp {
+	case socksAtypIPv4:
+		r := binary.BigEndian.Uint32(addr)
+		ip := net.IPv4(byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		return []net.IP{ip}, nil
+
+	case socksAtypIPv6:
+		return []net.IP{net.IP(addr)}, nil
+
+	case socksAtypDomain:
+		// A hostname reply is only useful when it is an address
+		// literal.
+		ip := net.ParseIP(string(addr))
+		if ip == nil {
+			return nil, ErrTorInvalidAddressResponse
+		}
+		return []net.IP{ip}, nil
+	}
+
+	return nil, ErrTorInvalidAddressResponse
+}
+
+// torLookupAddr uses Tor to perform a reverse DNS lookup of the passed IP
+// address via the RESOLVE_PTR SOCKS extension and returns the hostname it
+// maps to.
+func torLookupAddr(ctx context.Context, ip net.IP, proxy *socks.Proxy) ([]string, error) {
+	atyp := byte(socksAtypIPv6)
+	addr := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		atyp = socksAtypIPv4
+		addr = ip4
+	}
+	if addr == nil {
+		return nil, ErrTorInvalidAddressResponse
+	}
+
+	atyp, name, err := torResolve(ctx, proxy, torCmdResolvePTR, atyp, addr)
 	if err != nil {
 		return nil, err
 	}
-	if bytes != 4 {
+	if atyp != socksAtypDomain || len(name) == 0 {
 		return nil, ErrTorInvalidAddressResponse
 	}
 
-	r := binary.BigEndian.Uint32(buf)
+	return []string{string(name)}, nil
+}
+
+// torProxy wraps a SOCKS5 proxy which is assumed to be Tor and provides dial
+// and lookup functions which go through it.  When stream isolation is enabled,
+// each dial and lookup authenticates with a random, unique username and
+// password.  Tor isolates streams by SOCKS credentials by default
+// (IsolateSOCKSAuth), so every connection ends up on its own circuit which
+// makes it much harder to link our peers together.
+type torProxy struct {
+	proxy   *socks.Proxy
+	isolate bool
+}
 
-	addr := make([]net.IP, 1)
-	addr[0] = net.IPv4(byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+// newTorProxy returns a new torProxy for the passed proxy.  The credentials of
+// the passed proxy are ignored when isolate is true.
+func newTorProxy(proxy *socks.Proxy, isolate bool) *torProxy {
+	return &torProxy{proxy: proxy, isolate: isolate}
+}
+
+// socksProxy returns the proxy to use for a single dial or lookup.
+func (p *torProxy) socksProxy() (*socks.Proxy, error) {
+	if !p.isolate {
+		return p.proxy, nil
+	}
+
+	var buf [16]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return nil, err
+	}
+	return &socks.Proxy{
+		Addr:     p.proxy.Addr,
+		Username: hex.EncodeToString(buf[:8]),
+		Password: hex.EncodeToString(buf[8:]),
+	}, nil
+}
+
+// Dial connects to the address on the named network through the proxy.
+func (p *torProxy) Dial(network, addr string) (net.Conn, error) {
+	proxy, err := p.socksProxy()
+	if err != nil {
+		return nil, err
+	}
+	return proxy.Dial(network, addr)
+}
+
+// torResolver resolves hosts through a Tor proxy.  Every lookup is bounded by
+// the resolver's timeout in addition to any deadline on the context passed to
+// it, so a hung Tor daemon can't stall peer discovery indefinitely.
+type torResolver struct {
+	proxy   *torProxy
+	timeout time.Duration
+}
+
+// newTorResolver returns a new torResolver which performs lookups through the
+// passed proxy, giving up on each one after the passed timeout.
+func newTorResolver(proxy *torProxy, timeout time.Duration) *torResolver {
+	return &torResolver{proxy: proxy, timeout: timeout}
+}
+
+// LookupIPContext resolves the passed host using Tor's RESOLVE SOCKS
+// extension.
+func (r *torResolver) LookupIPContext(ctx context.Context, host string) ([]net.IP, error) {
+	proxy, err := r.proxy.socksProxy()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return torLookupIP(ctx, host, proxy)
+}
+
+// LookupAddrContext reverse resolves the passed IP address using Tor's
+// RESOLVE_PTR SOCKS extension.
+func (r *torResolver) LookupAddrContext(ctx context.Context, ip net.IP) ([]string, error) {
+	proxy, err := r.proxy.socksProxy()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return torLookupAddr(ctx, ip, proxy)
+}
 
-	return addr, nil
+// LookupIP resolves the passed host bounded only by the resolver's timeout.
+// It has the signature expected of the lookup functions in btcserver.Config.
+func (r *torResolver) LookupIP(host string) ([]net.IP, error) {
+	return r.LookupIPContext(context.Background(), host)
 }
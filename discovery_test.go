@@ -0,0 +1,356 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	socks "github.com/conformal/go-socks"
+)
+
+// fakeTorReply describes how fakeTorProxy answers a single connection.
+type fakeTorReply struct {
+	method     byte   // authentication method to select
+	authStatus byte   // RFC 1929 status when password authentication is used
+	status     byte   // status of the resolve reply
+	atyp       byte   // address type of the resolve reply
+	addr       []byte // address of the resolve reply without length prefix
+}
+
+// fakeTorRequest is a request received by fakeTorProxy.
+type fakeTorRequest struct {
+	user, pass string
+	cmd, atyp  byte
+	addr       []byte
+}
+
+// fakeTorProxy starts a fake Tor SOCKS5 proxy which answers a single
+// connection as described by the passed reply.  The request it received is
+// sent on the returned channel once the reply has been written.
+func fakeTorProxy(t *testing.T, reply fakeTorReply) (*socks.Proxy, <-chan fakeTorRequest) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	reqs := make(chan fakeTorRequest, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var req fakeTorRequest
+		if fakeTorServe(conn, &reply, &req) == nil {
+			reqs <- req
+		}
+	}()
+	return &socks.Proxy{Addr: l.Addr().String()}, reqs
+}
+
+// fakeTorServe performs the server side of a resolve request on the passed
+// connection.
+func fakeTorServe(conn net.Conn, reply *fakeTorReply, req *fakeTorRequest) error {
+	greeting := make([]byte, 3)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{5, reply.method}); err != nil {
+		return err
+	}
+	if reply.method != greeting[2] {
+		return io.EOF
+	}
+
+	if reply.method == socksAuthPassword {
+		user, err := readFakeTorField(conn, 1)
+		if err != nil {
+			return err
+		}
+		pass, err := readFakeTorField(conn, 0)
+		if err != nil {
+			return err
+		}
+		req.user, req.pass = string(user), string(pass)
+		_, err = conn.Write([]byte{1, reply.authStatus})
+		if err != nil || reply.authStatus != 0 {
+			return err
+		}
+	}
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	req.cmd, req.atyp = hdr[1], hdr[3]
+	var addr []byte
+	var err error
+	switch req.atyp {
+	case socksAtypIPv4:
+		addr = make([]byte, net.IPv4len)
+		_, err = io.ReadFull(conn, addr)
+	case socksAtypIPv6:
+		addr = make([]byte, net.IPv6len)
+		_, err = io.ReadFull(conn, addr)
+	case socksAtypDomain:
+		addr, err = readFakeTorField(conn, 0)
+	}
+	if err != nil {
+		return err
+	}
+	req.addr = addr
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return err
+	}
+
+	resp := []byte{5, reply.status, 0, reply.atyp}
+	if reply.atyp == socksAtypDomain {
+		resp = append(resp, byte(len(reply.addr)))
+	}
+	resp = append(resp, reply.addr...)
+	resp = append(resp, 0, 0)
+	_, err = conn.Write(resp)
+	return err
+}
+
+// readFakeTorField reads a length prefixed field after skipping the passed
+// number of bytes.
+func readFakeTorField(conn net.Conn, skip int) ([]byte, error) {
+	buf := make([]byte, skip+1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	field := make([]byte, buf[skip])
+	_, err := io.ReadFull(conn, field)
+	return field, err
+}
+
+// TestTorLookupIP ensures the address types of RESOLVE replies are decoded.
+func TestTorLookupIP(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply fakeTorReply
+		want  net.IP
+		err   error
+	}{
+		{
+			name:  "ipv4",
+			reply: fakeTorReply{atyp: socksAtypIPv4, addr: []byte{10, 1, 2, 3}},
+			want:  net.IPv4(10, 1, 2, 3),
+		},
+		{
+			name: "ipv6",
+			reply: fakeTorReply{atyp: socksAtypIPv6,
+				addr: net.ParseIP("2001:db8::1")},
+			want: net.ParseIP("2001:db8::1"),
+		},
+		{
+			name: "address literal",
+			reply: fakeTorReply{atyp: socksAtypDomain,
+				addr: []byte("192.0.2.1")},
+			want: net.IPv4(192, 0, 2, 1),
+		},
+		{
+			name: "hostname",
+			reply: fakeTorReply{atyp: socksAtypDomain,
+				addr: []byte("example.com")},
+			err: ErrTorInvalidAddressResponse,
+		},
+		{
+			name:  "unknown address type",
+			reply: fakeTorReply{atyp: 0x05},
+			err:   ErrTorInvalidAddressResponse,
+		},
+	}
+
+	for _, test := range tests {
+		proxy, reqs := fakeTorProxy(t, test.reply)
+		ips, err := torLookupIP(context.Background(), "seed.example",
+			proxy)
+		if err != test.err {
+			t.Errorf("%s: unexpected error - got %v, want %v",
+				test.name, err, test.err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		if len(ips) != 1 || !ips[0].Equal(test.want) {
+			t.Errorf("%s: unexpected result - got %v, want %v",
+				test.name, ips, test.want)
+		}
+		req := <-reqs
+		if req.cmd != torCmdResolve || req.atyp != socksAtypDomain ||
+			string(req.addr) != "seed.example" {
+
+			t.Errorf("%s: unexpected request %+v", test.name, req)
+		}
+	}
+}
+
+// TestTorLookupAddr ensures RESOLVE_PTR requests are sent with the address
+// type of the passed IP address and that their replies are decoded.
+func TestTorLookupAddr(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		atyp byte
+		addr []byte
+	}{
+		{net.IPv4(192, 0, 2, 1), socksAtypIPv4, []byte{192, 0, 2, 1}},
+		{net.ParseIP("2001:db8::1"), socksAtypIPv6,
+			net.ParseIP("2001:db8::1")},
+	}
+
+	for _, test := range tests {
+		proxy, reqs := fakeTorProxy(t, fakeTorReply{
+			atyp: socksAtypDomain,
+			addr: []byte("host.example"),
+		})
+		names, err := torLookupAddr(context.Background(), test.ip, proxy)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.ip, err)
+			continue
+		}
+		if len(names) != 1 || names[0] != "host.example" {
+			t.Errorf("%v: unexpected result %v", test.ip, names)
+		}
+		req := <-reqs
+		if req.cmd != torCmdResolvePTR || req.atyp != test.atyp ||
+			!bytes.Equal(req.addr, test.addr) {
+
+			t.Errorf("%v: unexpected request %+v", test.ip, req)
+		}
+	}
+
+	// A reply which isn't a hostname is invalid.
+	proxy, _ := fakeTorProxy(t, fakeTorReply{
+		atyp: socksAtypIPv4,
+		addr: []byte{192, 0, 2, 1},
+	})
+	_, err := torLookupAddr(context.Background(), net.IPv4(192, 0, 2, 1),
+		proxy)
+	if err != ErrTorInvalidAddressResponse {
+		t.Errorf("ipv4 reply: unexpected error - got %v, want %v", err,
+			ErrTorInvalidAddressResponse)
+	}
+}
+
+// TestTorAuthenticate ensures RFC 1929 username/password authentication is
+// used when the proxy has credentials and that failures are reported.
+func TestTorAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		user, pass string
+		reply      fakeTorReply
+		err        error
+	}{
+		{
+			name:  "no credentials",
+			reply: fakeTorReply{method: socksAuthNone},
+		},
+		{
+			name:  "success",
+			user:  "user",
+			pass:  "pass",
+			reply: fakeTorReply{method: socksAuthPassword},
+		},
+		{
+			name: "failure",
+			user: "user",
+			pass: "wrong",
+			reply: fakeTorReply{method: socksAuthPassword,
+				authStatus: 1},
+			err: ErrTorAuthFailed,
+		},
+		{
+			name:  "method rejected",
+			user:  "user",
+			pass:  "pass",
+			reply: fakeTorReply{method: 0xFF},
+			err:   ErrTorUnrecognizedAuthMethod,
+		},
+	}
+
+	for _, test := range tests {
+		test.reply.atyp = socksAtypIPv4
+		test.reply.addr = []byte{10, 0, 0, 1}
+		proxy, reqs := fakeTorProxy(t, test.reply)
+		proxy.Username, proxy.Password = test.user, test.pass
+
+		_, err := torLookupIP(context.Background(), "seed.example",
+			proxy)
+		if err != test.err {
+			t.Errorf("%s: unexpected error - got %v, want %v",
+				test.name, err, test.err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		req := <-reqs
+		if req.user != test.user || req.pass != test.pass {
+			t.Errorf("%s: unexpected credentials %q:%q", test.name,
+				req.user, req.pass)
+		}
+	}
+}
+
+// TestTorStatusErrors ensures every failure status of a resolve reply is
+// mapped to its error and unknown ones are rejected.
+func TestTorStatusErrors(t *testing.T) {
+	for status := byte(torGeneralError); status <= 0x09; status++ {
+		want, ok := torStatusErrors[status]
+		if !ok {
+			want = ErrTorInvalidProxyResponse
+		}
+		proxy, _ := fakeTorProxy(t, fakeTorReply{
+			status: status,
+			atyp:   socksAtypIPv4,
+			addr:   []byte{0, 0, 0, 0},
+		})
+		_, err := torLookupIP(context.Background(), "seed.example",
+			proxy)
+		if err != want {
+			t.Errorf("status %#x: unexpected error - got %v, want %v",
+				status, err, want)
+		}
+	}
+}
+
+// TestTorResolveTimeout ensures a proxy which never replies is bounded by the
+// deadline of the context.
+func TestTorResolveTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+	_, err = torLookupIP(ctx, "seed.example",
+		&socks.Proxy{Addr: l.Addr().String()})
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error - got %v, want %v", err,
+			context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	flags "github.com/conformal/go-flags"
+)
+
+const (
+	// envPrefix is the prefix of the environment variables which set
+	// configuration options.  The rest of the name is the long option name
+	// in upper case, with dashes replaced by underscores.
+	envPrefix = "BTCD_"
+
+	// envFileSuffix is the suffix of the environment variables which name
+	// a file to read the value of an option from.  It allows secrets such
+	// as the RPC password to be kept out of the environment.
+	envFileSuffix = "_FILE"
+)
+
+// unmarshalerType is the type of the interface implemented by option types
+// which parse their own values.
+var unmarshalerType = reflect.TypeOf((*flags.Unmarshaler)(nil)).Elem()
+
+// configOptions returns the kinds of all options declared on the passed config
+// struct type keyed by their long names.  Nested structs are scanned in the
+// same way they are parsed.
+func configOptions(t reflect.Type, options map[string]reflect.Kind) map[string]reflect.Kind {
+	if options == nil {
+		options = make(map[string]reflect.Kind)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		long := field.Tag.Get("long")
+		if long == "" {
+			if field.Type.Kind() == reflect.Struct {
+				configOptions(field.Type, options)
+			}
+			continue
+		}
+		// Options which parse their own value, such as those which
+		// default to on, take it as is.
+		kind := field.Type.Kind()
+		if reflect.PtrTo(field.Type).Implements(unmarshalerType) {
+			kind = reflect.String
+		}
+		options[long] = kind
+	}
+	return options
+}
+
+// envName returns the name of the environment variable for the passed long
+// option name.
+func envName(long string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(long, "-", "_", -1))
+}
+
+// lookupEnv returns the value of the environment variable for the passed long
+// option name, reading it from the file named by the _FILE variant when that
+// is set instead.  Setting both variables is an error.
+func lookupEnv(long string) (string, bool, error) {
+	name := envName(long)
+	value, ok := os.LookupEnv(name)
+	path, fileOK := os.LookupEnv(name + envFileSuffix)
+	switch {
+	case ok && fileOK:
+		return "", false, fmt.Errorf("only one of %s and %s%s may be "+
+			"set", name, name, envFileSuffix)
+	case fileOK:
+		b, err := ioutil.ReadFile(cleanAndExpandPath(path))
+		if err != nil {
+			return "", false, fmt.Errorf("unable to read %s%s: %v",
+				name, envFileSuffix, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+	return value, ok, nil
+}
+
+// envOptions contains the options set through BTCD_<OPTION> environment
+// variables.
+type envOptions struct {
+	// args contains command line arguments equivalent to the options, so
+	// they can be parsed by the same parser as the command line.
+	args []string
+
+	// disabled contains the long names of the boolean options which are
+	// set to a false value.  Boolean flags can only enable an option on
+	// the command line, so these are applied by disable instead.
+	disabled map[string]struct{}
+
+	// unknown contains the names of the variables with the prefix which do
+	// not match any option.
+	unknown []string
+}
+
+// envArgs returns the options set through BTCD_<OPTION> environment
+// variables.  Boolean options are enabled or disabled by any value accepted by
+// strconv.ParseBool, and options which may be specified multiple times take a
+// comma separated list.  Variables with the prefix which do not match any
+// option are collected so misspellings can be reported.
+func envArgs(cfg *config) (*envOptions, error) {
+	options := configOptions(reflect.TypeOf(*cfg), nil)
+	names := make([]string, 0, len(options))
+	for long := range options {
+		names = append(names, long)
+	}
+	sort.Strings(names)
+
+	known := make(map[string]struct{}, len(options)*2)
+	env := &envOptions{disabled: make(map[string]struct{})}
+	for _, long := range names {
+		known[envName(long)] = struct{}{}
+		known[envName(long)+envFileSuffix] = struct{}{}
+
+		value, ok, err := lookupEnv(long)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		switch options[long] {
+		case reflect.Bool:
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid boolean value "+
+					"for %s: %v", envName(long), err)
+			}
+			if enabled {
+				env.args = append(env.args, "--"+long)
+			} else {
+				env.disabled[long] = struct{}{}
+			}
+
+		case reflect.Slice:
+			for _, v := range strings.Split(value, ",") {
+				v = strings.TrimSpace(v)
+				if v != "" {
+					env.args = append(env.args, "--"+long+"="+v)
+				}
+			}
+
+		default:
+			env.args = append(env.args, "--"+long+"="+value)
+		}
+	}
+
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		if _, ok := known[name]; !ok {
+			env.unknown = append(env.unknown, name)
+		}
+	}
+	sort.Strings(env.unknown)
+
+	return env, nil
+}
+
+// parse parses the options with the passed parser, whose options are those of
+// the passed config, and then disables the boolean options set to false, so
+// they override those set before, such as by the config file.
+func (env *envOptions) parse(parser *flags.Parser, cfg *config) error {
+	if _, err := parser.ParseArgs(env.args); err != nil {
+		return err
+	}
+	env.disable(cfg)
+	return nil
+}
+
+// disable sets the boolean options of the passed config which are set to false
+// through environment variables to false.
+func (env *envOptions) disable(cfg *config) {
+	if len(env.disabled) > 0 {
+		disableOptions(reflect.ValueOf(cfg).Elem(), env.disabled)
+	}
+}
+
+// disableOptions sets the boolean options of the passed config struct value
+// with the passed long names to false.  Nested structs are scanned in the same
+// way they are parsed.
+func disableOptions(v reflect.Value, names map[string]struct{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		long := field.Tag.Get("long")
+		if long == "" {
+			if field.Type.Kind() == reflect.Struct {
+				disableOptions(v.Field(i), names)
+			}
+			continue
+		}
+		if _, ok := names[long]; ok && field.Type.Kind() == reflect.Bool {
+			v.Field(i).SetBool(false)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	flags "github.com/conformal/go-flags"
+)
+
+// setTestEnv replaces all BTCD_ environment variables with the passed ones and
+// returns a function which restores the previous ones.
+func setTestEnv(vars map[string]string) func() {
+	saved := make(map[string]string)
+	for _, kv := range os.Environ() {
+		fields := strings.SplitN(kv, "=", 2)
+		if strings.HasPrefix(fields[0], envPrefix) {
+			saved[fields[0]] = fields[1]
+			os.Unsetenv(fields[0])
+		}
+	}
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+// TestEnvName ensures long option names map to environment variable names.
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		long string
+		want string
+	}{
+		{"rpcpass", "BTCD_RPCPASS"},
+		{"proxy-user", "BTCD_PROXY_USER"},
+		{"logmaxfiles", "BTCD_LOGMAXFILES"},
+	}
+
+	for _, test := range tests {
+		if got := envName(test.long); got != test.want {
+			t.Errorf("envName(%q): got %s, want %s", test.long, got,
+				test.want)
+		}
+	}
+}
+
+// TestEnvArgs ensures environment variables are converted to the equivalent
+// command line arguments according to the kind of their options.
+func TestEnvArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	formatFile := filepath.Join(dir, "logformat")
+	err = ioutil.WriteFile(formatFile, []byte("json\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		vars         map[string]string
+		want         []string
+		wantDisabled []string
+		wantUnknown  []string
+		err          bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "string",
+			vars: map[string]string{"BTCD_LOGFORMAT": "json"},
+			want: []string{"--logformat=json"},
+		},
+		{
+			name: "duration",
+			vars: map[string]string{"BTCD_PROXYTIMEOUT": "30s"},
+			want: []string{"--proxytimeout=30s"},
+		},
+		{
+			name: "boolean enabled",
+			vars: map[string]string{"BTCD_NOLISTEN": "true"},
+			want: []string{"--nolisten"},
+		},
+		{
+			name:         "boolean disabled",
+			vars:         map[string]string{"BTCD_NOLISTEN": "0"},
+			wantDisabled: []string{"nolisten"},
+		},
+		{
+			name: "invalid boolean",
+			vars: map[string]string{"BTCD_NOLISTEN": "maybe"},
+			err:  true,
+		},
+		{
+			name: "optional value",
+			vars: map[string]string{"BTCD_RPCAUTOCERT": "false"},
+			want: []string{"--rpcautocert=false"},
+		},
+		{
+			name: "list",
+			vars: map[string]string{
+				"BTCD_ADDPEER": "10.0.0.1, 10.0.0.2:8334,",
+			},
+			want: []string{
+				"--addpeer=10.0.0.1",
+				"--addpeer=10.0.0.2:8334",
+			},
+		},
+		{
+			name: "file",
+			vars: map[string]string{"BTCD_LOGFORMAT_FILE": formatFile},
+			want: []string{"--logformat=json"},
+		},
+		{
+			name: "missing file",
+			vars: map[string]string{
+				"BTCD_LOGFORMAT_FILE": filepath.Join(dir, "missing"),
+			},
+			err: true,
+		},
+		{
+			name: "value and file",
+			vars: map[string]string{
+				"BTCD_LOGFORMAT":      "text",
+				"BTCD_LOGFORMAT_FILE": formatFile,
+			},
+			err: true,
+		},
+		{
+			name: "unknown",
+			vars: map[string]string{
+				"BTCD_NOSUCHOPTION": "1",
+				"BTCD_LOGFORMAT_X":  "json",
+			},
+			wantUnknown: []string{"BTCD_LOGFORMAT_X",
+				"BTCD_NOSUCHOPTION"},
+		},
+	}
+
+	for _, test := range tests {
+		restore := setTestEnv(test.vars)
+		env, err := envArgs(&config{})
+		restore()
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: unexpected success", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if (len(env.args) > 0 || len(test.want) > 0) &&
+			!reflect.DeepEqual(env.args, test.want) {
+
+			t.Errorf("%s: unexpected arguments - got %q, want %q",
+				test.name, env.args, test.want)
+		}
+		var disabled []string
+		for long := range env.disabled {
+			disabled = append(disabled, long)
+		}
+		if !reflect.DeepEqual(disabled, test.wantDisabled) {
+			t.Errorf("%s: unexpected disabled options - got %v, "+
+				"want %v", test.name, disabled, test.wantDisabled)
+		}
+		if !reflect.DeepEqual(env.unknown, test.wantUnknown) {
+			t.Errorf("%s: unexpected unknown variables - got %v, "+
+				"want %v", test.name, env.unknown, test.wantUnknown)
+		}
+	}
+}
+
+// TestEnvDisable ensures boolean options disabled through environment variables
+// override the config file, including when the config file selects the
+// network.
+func TestEnvDisable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "btcd.conf")
+	err = ioutil.WriteFile(configFile, []byte("testnet=1\nnolisten=1\n"+
+		"[testnet]\nmaxpeers=3\n[mainnet]\nmaxpeers=7\n"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+
+	restore := setTestEnv(map[string]string{
+		"BTCD_TESTNET":  "false",
+		"BTCD_NOLISTEN": "0",
+	})
+	env, err := envArgs(&config{})
+	restore()
+	if err != nil {
+		t.Fatalf("envArgs: unexpected error: %v", err)
+	}
+
+	cfg := &config{}
+	cfg.ConfigFile = configFile
+	so := &serviceOptions{}
+	entries, err := readNetworkConfigFile(cfg, so, env)
+	if err != nil {
+		t.Fatalf("readNetworkConfigFile: unexpected error: %v", err)
+	}
+	parser := newConfigParser(cfg, so, flags.IgnoreUnknown)
+	if err := parseConfigEntries(parser, entries); err != nil {
+		t.Fatalf("parseConfigEntries: unexpected error: %v", err)
+	}
+	if err := env.parse(parser, cfg); err != nil {
+		t.Fatalf("parse: unexpected error: %v", err)
+	}
+	if cfg.TestNet3 || cfg.DisableListen || cfg.MaxPeers != 7 {
+		t.Errorf("unexpected options - testnet %v, nolisten %v, "+
+			"maxpeers %d", cfg.TestNet3, cfg.DisableListen,
+			cfg.MaxPeers)
+	}
+}
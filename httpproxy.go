@@ -0,0 +1,144 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpProxyTimeout is the maximum time to wait for an HTTP proxy to establish
+// a tunnel.
+const httpProxyTimeout = time.Second * 30
+
+// httpProxy is an HTTP proxy which supports tunneling connections with the
+// CONNECT method.  Basic authentication is used when a username or password is
+// set.
+type httpProxy struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+// isHTTPProxy returns whether the passed proxy specification refers to an HTTP
+// proxy rather than a SOCKS5 proxy.
+func isHTTPProxy(proxy string) bool {
+	return strings.HasPrefix(strings.ToLower(proxy), "http://")
+}
+
+// parseProxyURL parses the passed proxy URL.  Unlike the errors of url.Parse,
+// the returned errors don't include the URL since it may contain a password.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		if e, ok := err.(*url.Error); ok {
+			return nil, e.Err
+		}
+		return nil, err
+	}
+	return u, nil
+}
+
+// redactURLPassword returns the passed proxy URL, or host:port with
+// credentials, with the password redacted so it can be shown.  Strings without
+// a password are returned unchanged.
+func redactURLPassword(s string) string {
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return s
+	}
+	start := 0
+	if i := strings.Index(s[:at], "://"); i >= 0 {
+		start = i + 3
+	}
+	colon := strings.Index(s[start:at], ":")
+	if colon < 0 {
+		return s
+	}
+	return s[:start+colon+1] + "<redacted>" + s[at:]
+}
+
+// newHTTPProxy returns a new httpProxy for the passed http://[user:pass@]
+// host:port URL.  Credentials included in the URL take precedence over the
+// passed username and password.
+func newHTTPProxy(proxyURL, username, password string) (*httpProxy, error) {
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing proxy address")
+	}
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	return &httpProxy{Addr: u.Host, Username: username, Password: password}, nil
+}
+
+// bufferedConn is a net.Conn which first returns any data that was read into
+// a buffer while reading the proxy's response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads data from the buffer before reading from the connection.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Dial connects to the address on the named network through the proxy.  Only
+// TCP networks are supported.
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("http proxy does not support network %s",
+			network)
+	}
+
+	conn, err := net.DialTimeout("tcp", p.Addr, httpProxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(httpProxyTimeout))
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if p.Username != "" || p.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.Username +
+			":" + p.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	_, err = conn.Write([]byte(req))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy refused connection to %s: %s",
+			addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
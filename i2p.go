@@ -0,0 +1,522 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hlandauf/btcd/logformat"
+)
+
+const (
+	// samTimeout is the maximum time to wait for the SAM bridge to answer
+	// a command.  It does not apply to STREAM ACCEPT, which waits for an
+	// incoming connection indefinitely.
+	samTimeout = time.Second * 60
+
+	// samVersion is the version of the SAM protocol used.
+	samVersion = "3.1"
+
+	// samSignatureType is the signature type used for newly created
+	// destinations (EdDSA_SHA512_Ed25519).
+	samSignatureType = "7"
+
+	// i2pKeyFilename is the name of the file in the data directory in
+	// which the private destination of the I2P session is kept so the
+	// node retains the same I2P address across restarts.
+	i2pKeyFilename = "i2p.key"
+)
+
+var (
+	ErrI2PSessionClosed = errors.New("i2p session is not open")
+	ErrI2PAddrInUse     = errors.New("i2p destinations share a mapped " +
+		"address")
+	ErrI2PInvalidReply = errors.New("invalid SAM bridge reply")
+)
+
+// i2pEncoding is the base64 alphabet used by I2P for destinations.
+var i2pEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
+	"abcdefghijklmnopqrstuvwxyz0123456789-~")
+
+// isI2PHost returns whether the passed host is an I2P hostname.
+func isI2PHost(host string) bool {
+	return strings.HasSuffix(strings.ToLower(host), ".i2p")
+}
+
+// isI2PAddr returns whether the passed host:port address refers to an I2P
+// host.
+func isI2PAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return isI2PHost(host)
+}
+
+// samConn is a connection to an I2P SAM v3 bridge.
+type samConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialSAM connects to the SAM bridge at the passed address and performs the
+// version handshake.
+func dialSAM(addr string) (*samConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, samTimeout)
+	if err != nil {
+		return nil, err
+	}
+	sc := &samConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	_, err = sc.command("HELLO VERSION MIN=" + samVersion + " MAX=" +
+		samVersion)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// readReply reads a single reply line from the bridge, parses its arguments
+// and returns an error when the reply does not indicate success.
+func (c *samConn) readReply() (map[string]string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	args := parseControlArgs(strings.TrimRight(line, "\r\n"))
+	if result := args["RESULT"]; result != "OK" {
+		if msg := args["MESSAGE"]; msg != "" {
+			return nil, fmt.Errorf("SAM bridge error %s: %s", result,
+				msg)
+		}
+		if result == "" {
+			return nil, ErrI2PInvalidReply
+		}
+		return nil, fmt.Errorf("SAM bridge error %s", result)
+	}
+	return args, nil
+}
+
+// command sends the passed command to the bridge and returns the arguments of
+// its reply.
+func (c *samConn) command(cmd string) (map[string]string, error) {
+	c.SetDeadline(time.Now().Add(samTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	_, err := c.Write([]byte(cmd + "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// Read reads stream data, including any which was buffered while reading the
+// replies which preceded it.
+func (c *samConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// i2pSession is a SAM stream session through which connections to and from
+// I2P peers are made.  The session is created by start and remains open until
+// Close is called.
+type i2pSession struct {
+	samAddr string
+	keyFile string
+
+	mtx  sync.Mutex
+	id   string
+	ctl  *samConn
+	addr string
+
+	// dests maps the addresses returned by LookupIP to the destinations
+	// of the hosts they were looked up for.
+	dests map[string]string
+}
+
+// newI2PSession returns a new, not yet started, I2P session which uses the SAM
+// bridge at the passed address and keeps its private destination in the passed
+// key file.
+func newI2PSession(samAddr, keyFile string) *i2pSession {
+	return &i2pSession{
+		samAddr: samAddr,
+		keyFile: keyFile,
+		dests:   make(map[string]string),
+	}
+}
+
+// i2pB32Address returns the .b32.i2p address of the passed base64 encoded
+// public destination.
+func i2pB32Address(dest string) (string, error) {
+	raw, err := i2pEncoding.DecodeString(dest)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(raw)
+	b32 := base32.StdEncoding.EncodeToString(hash[:])
+	return strings.ToLower(strings.TrimRight(b32, "=")) + ".b32.i2p", nil
+}
+
+// start creates the SAM session using the destination saved in the key file,
+// or a new one if there is none yet, and returns the .b32.i2p address of the
+// session.
+func (s *i2pSession) start() (string, error) {
+	dest := "TRANSIENT"
+	if keyBytes, err := ioutil.ReadFile(s.keyFile); err == nil {
+		dest = strings.TrimSpace(string(keyBytes))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var idBytes [8]byte
+	_, err := rand.Read(idBytes[:])
+	if err != nil {
+		return "", err
+	}
+	id := "btcd-" + hex.EncodeToString(idBytes[:])
+
+	ctl, err := dialSAM(s.samAddr)
+	if err != nil {
+		return "", err
+	}
+	args, err := ctl.command(fmt.Sprintf("SESSION CREATE STYLE=STREAM "+
+		"ID=%s DESTINATION=%s SIGNATURE_TYPE=%s", id, dest,
+		samSignatureType))
+	if err != nil {
+		ctl.Close()
+		return "", err
+	}
+	if privDest := args["DESTINATION"]; privDest != dest && privDest != "" {
+		err = os.MkdirAll(filepath.Dir(s.keyFile), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(s.keyFile, []byte(privDest+"\n"),
+				0600)
+		}
+		if err != nil {
+			log.Warnf("Unable to save I2P destination: %v", err)
+		}
+	}
+
+	// Look up the public destination of the session to derive its
+	// address.
+	args, err = ctl.command("NAMING LOOKUP NAME=ME")
+	if err != nil {
+		ctl.Close()
+		return "", err
+	}
+	addr, err := i2pB32Address(args["VALUE"])
+	if err != nil {
+		ctl.Close()
+		return "", err
+	}
+
+	s.mtx.Lock()
+	s.id, s.ctl, s.addr = id, ctl, addr
+	s.mtx.Unlock()
+	return addr, nil
+}
+
+// sessionID returns the ID of the session or an error if it is not open.
+func (s *i2pSession) sessionID() (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ctl == nil {
+		return "", ErrI2PSessionClosed
+	}
+	return s.id, nil
+}
+
+// LookupIP resolves the passed I2P host to its destination using NAMING LOOKUP
+// and returns the address the destination maps to, as returned by
+// i2pSourceAddr.  The server only knows peers by IP address, so it connects to
+// I2P peers through these addresses, which Dial maps back to the destinations.
+func (s *i2pSession) LookupIP(host string) ([]net.IP, error) {
+	conn, err := dialSAM(s.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	args, err := conn.command("NAMING LOOKUP NAME=" + host)
+	if err != nil {
+		return nil, err
+	}
+
+	dest := args["VALUE"]
+	ip := i2pSourceAddr(dest)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if other, ok := s.dests[ip.String()]; ok && other != dest {
+		return nil, ErrI2PAddrInUse
+	}
+	s.dests[ip.String()] = dest
+	return []net.IP{ip}, nil
+}
+
+// mappedDest returns the destination the passed address was mapped to by
+// LookupIP, if any.
+func (s *i2pSession) mappedDest(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	dest, ok := s.dests[ip.String()]
+	return dest, ok
+}
+
+// routes returns whether the passed address is dialed through the session,
+// that is whether it is an I2P address or an address returned by LookupIP.
+func (s *i2pSession) routes(addr string) bool {
+	if isI2PAddr(addr) {
+		return true
+	}
+	_, ok := s.mappedDest(addr)
+	return ok
+}
+
+// Dial connects to the passed I2P address, or to an address returned by
+// LookupIP, using STREAM CONNECT.  The port, if any, is ignored since I2P
+// destinations have no ports.
+func (s *i2pSession) Dial(network, addr string) (net.Conn, error) {
+	id, err := s.sessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialSAM(s.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	dest, ok := s.mappedDest(addr)
+	if !ok {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		args, err := conn.command("NAMING LOOKUP NAME=" + host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		dest = args["VALUE"]
+	}
+	_, err = conn.command(fmt.Sprintf("STREAM CONNECT ID=%s "+
+		"DESTINATION=%s SILENT=false", id, dest))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// accept waits for an incoming connection to the session using STREAM ACCEPT
+// and returns it along with the base64 encoded destination of the remote peer.
+func (s *i2pSession) accept() (net.Conn, string, error) {
+	id, err := s.sessionID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := dialSAM(s.samAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = conn.command(fmt.Sprintf("STREAM ACCEPT ID=%s SILENT=false",
+		id))
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+
+	// The bridge sends the destination of the remote peer on a line of its
+	// own once a connection arrives, optionally followed by the ports.
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		conn.Close()
+		return nil, "", ErrI2PInvalidReply
+	}
+	return conn, fields[0], nil
+}
+
+// i2pSourceAddr returns the loopback address incoming connections from the
+// passed destination are forwarded from.  Each destination maps to its own
+// address in 127.128.0.0/9 so the server tells I2P peers apart, and banning
+// one of them doesn't ban every I2P peer along with it.
+func i2pSourceAddr(dest string) net.IP {
+	hash := sha256.Sum256([]byte(dest))
+	return net.IPv4(127, 128|hash[0], hash[1], hash[2])
+}
+
+// i2pForwardTarget returns the loopback address of the first of the passed
+// P2P listeners which incoming I2P connections can be forwarded to.  The
+// listener must be reachable over IPv4 loopback, and the platform must allow
+// binding to the addresses returned by i2pSourceAddr.
+func i2pForwardTarget(listeners []string) (string, error) {
+	var target string
+	for _, listener := range listeners {
+		addr, err := loopbackTarget(listener)
+		if err != nil {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			target = addr
+			break
+		}
+	}
+	if target == "" {
+		return "", errors.New("no IPv4 P2P listener to forward them to")
+	}
+
+	// Not every platform routes all of 127.0.0.0/8 to the loopback
+	// interface.
+	l, err := net.Listen("tcp", net.JoinHostPort(
+		i2pSourceAddr("").String(), "0"))
+	if err != nil {
+		return "", fmt.Errorf("unable to bind to a loopback address "+
+			"to forward them from: %v", err)
+	}
+	l.Close()
+	return target, nil
+}
+
+// serve accepts incoming I2P connections and forwards each of them to the
+// passed local P2P listener address until the session is closed.
+func (s *i2pSession) serve(target string) {
+	for {
+		conn, dest, err := s.accept()
+		if err != nil {
+			if _, err := s.sessionID(); err != nil {
+				return
+			}
+			log.Warnf("Unable to accept I2P connection: %v", err)
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		source := i2pSourceAddr(dest)
+		if addr, err := i2pB32Address(dest); err == nil {
+			log.Debugf("Forwarding I2P connection from %s as %s",
+				logformat.F("address", addr), source)
+		}
+		go spliceConn(conn, target, source)
+	}
+}
+
+// spliceConn connects to the passed target address from the passed local
+// address and copies data between it and the passed connection until either
+// side is closed.
+func spliceConn(conn net.Conn, target string, source net.IP) {
+	defer conn.Close()
+
+	dialer := net.Dialer{
+		Timeout:   samTimeout,
+		LocalAddr: &net.TCPAddr{IP: source},
+	}
+	local, err := dialer.Dial("tcp", target)
+	if err != nil {
+		log.Warnf("Unable to forward I2P connection to %s: %v",
+			logformat.F("address", target), err)
+		return
+	}
+	defer local.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, local)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Close closes the session.  The bridge tears down the session along with all
+// of its streams once the control connection is closed.
+func (s *i2pSession) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.ctl == nil {
+		return nil
+	}
+	err := s.ctl.Close()
+	s.ctl = nil
+	return err
+}
+
+// i2pRoutes returns dial and lookup functions which route I2P hosts, and the
+// addresses they are looked up to, through the passed session while all other
+// traffic uses the passed functions.
+func i2pRoutes(s *i2pSession, dial func(string, string) (net.Conn, error),
+	lookup func(string) ([]net.IP, error)) (func(string, string) (net.Conn, error),
+	func(string) ([]net.IP, error)) {
+
+	i2pDial := func(network, addr string) (net.Conn, error) {
+		if s.routes(addr) {
+			return s.Dial(network, addr)
+		}
+		return dial(network, addr)
+	}
+	i2pLookup := func(host string) ([]net.IP, error) {
+		if isI2PHost(host) {
+			return s.LookupIP(host)
+		}
+		return lookup(host)
+	}
+	return i2pDial, i2pLookup
+}
+
+// startI2PSession starts the I2P session of the passed configuration.  When
+// listening is enabled, incoming I2P connections are forwarded to a P2P
+// listener.  The I2P address of the session is not advertised since the
+// address messages of the P2P protocol can't carry it.
+func startI2PSession(cfg *config) error {
+	addr, err := cfg.i2p.start()
+	if err != nil {
+		return err
+	}
+	log.Infof("I2P session started with address %s",
+		logformat.F("address", addr))
+
+	if cfg.DisableListen {
+		return nil
+	}
+	target, err := i2pForwardTarget(cfg.Listeners)
+	if err != nil {
+		log.Warnf("Not accepting incoming I2P connections: %v", err)
+		return nil
+	}
+	go cfg.i2p.serve(target)
+	log.Infof("Accepting incoming I2P connections -- the I2P address is "+
+		"not advertised to peers, so share %s out of band",
+		logformat.F("address", addr))
+	return nil
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	// i2pTestDest and i2pTestPeerDest are the public destinations of the
+	// test session and of its remote peer.
+	i2pTestDest     = i2pEncoding.EncodeToString(bytes.Repeat([]byte{1}, 387))
+	i2pTestPeerDest = i2pEncoding.EncodeToString(bytes.Repeat([]byte{2}, 387))
+)
+
+// fakeSAMBridge starts a fake SAM v3 bridge and returns its address.  Stream
+// connections echo the data sent over them, and accepted streams come from
+// i2pTestPeerDest and start with "ping".
+func fakeSAMBridge(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSAM(conn)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// serveFakeSAM answers the commands sent over a connection to fakeSAMBridge.
+func serveFakeSAM(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(cmd, "HELLO VERSION "):
+			io.WriteString(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+		case strings.HasPrefix(cmd, "SESSION CREATE "):
+			io.WriteString(conn, "SESSION STATUS RESULT=OK "+
+				"DESTINATION=PRIVATE\n")
+		case cmd == "NAMING LOOKUP NAME=ME":
+			io.WriteString(conn, "NAMING REPLY RESULT=OK NAME=ME "+
+				"VALUE="+i2pTestDest+"\n")
+		case cmd == "NAMING LOOKUP NAME=peer.i2p":
+			io.WriteString(conn, "NAMING REPLY RESULT=OK "+
+				"NAME=peer.i2p VALUE="+i2pTestPeerDest+"\n")
+		case strings.HasPrefix(cmd, "NAMING LOOKUP "):
+			io.WriteString(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND\n")
+		case strings.HasPrefix(cmd, "STREAM CONNECT ") &&
+			strings.Contains(cmd, "DESTINATION="+i2pTestPeerDest):
+
+			io.WriteString(conn, "STREAM STATUS RESULT=OK\n")
+			io.Copy(conn, r)
+			return
+		case strings.HasPrefix(cmd, "STREAM ACCEPT "):
+			io.WriteString(conn, "STREAM STATUS RESULT=OK\n"+
+				i2pTestPeerDest+" FROM_PORT=0 TO_PORT=0\nping")
+			io.Copy(ioutil.Discard, r)
+			return
+		default:
+			io.WriteString(conn, "STREAM STATUS RESULT=I2P_ERROR "+
+				"MESSAGE=\"unexpected command\"\n")
+		}
+	}
+}
+
+// TestI2PB32Address ensures .b32.i2p addresses are derived from destinations.
+func TestI2PB32Address(t *testing.T) {
+	addr, err := i2pB32Address(i2pTestDest)
+	if err != nil {
+		t.Fatalf("i2pB32Address: unexpected error: %v", err)
+	}
+	if len(addr) != 52+len(".b32.i2p") || addr != strings.ToLower(addr) ||
+		!strings.HasSuffix(addr, ".b32.i2p") {
+
+		t.Errorf("i2pB32Address: invalid address %q", addr)
+	}
+	if other, _ := i2pB32Address(i2pTestPeerDest); other == addr {
+		t.Errorf("i2pB32Address: destinations share address %q", addr)
+	}
+	if _, err := i2pB32Address("not base64!"); err == nil {
+		t.Errorf("i2pB32Address: unexpected success for invalid " +
+			"destination")
+	}
+}
+
+// TestI2PSession ensures a session is created, its destination saved and that
+// streams can be opened and accepted through it.
+func TestI2PSession(t *testing.T) {
+	samAddr, closeBridge := fakeSAMBridge(t)
+	defer closeBridge()
+	dir, err := ioutil.TempDir("", "i2p")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, i2pKeyFilename)
+	s := newI2PSession(samAddr, keyFile)
+	if _, err := s.Dial("tcp", "peer.i2p:8333"); err != ErrI2PSessionClosed {
+		t.Errorf("Dial before start: unexpected error - got %v, want %v",
+			err, ErrI2PSessionClosed)
+	}
+
+	addr, err := s.start()
+	if err != nil {
+		t.Fatalf("start: unexpected error: %v", err)
+	}
+	defer s.Close()
+	want, _ := i2pB32Address(i2pTestDest)
+	if addr != want {
+		t.Errorf("start: unexpected address - got %s, want %s", addr,
+			want)
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil || string(key) != "PRIVATE\n" {
+		t.Errorf("start: destination not saved: %q %v", key, err)
+	}
+
+	// Outgoing streams are connected to the destination of the host.
+	conn, err := s.Dial("tcp", "peer.i2p:8333")
+	if err != nil {
+		t.Fatalf("Dial: unexpected error: %v", err)
+	}
+	io.WriteString(conn, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil ||
+		string(buf) != "hello" {
+
+		t.Errorf("Dial: unexpected echo %q %v", buf, err)
+	}
+	conn.Close()
+	if _, err := s.Dial("tcp", "unknown.i2p:8333"); err == nil {
+		t.Errorf("Dial: unexpected success for unknown host")
+	}
+
+	// Incoming streams report the destination of the peer and keep any
+	// data which followed it.
+	conn, dest, err := s.accept()
+	if err != nil {
+		t.Fatalf("accept: unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if dest != i2pTestPeerDest {
+		t.Errorf("accept: unexpected destination %q", dest)
+	}
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("accept: unexpected data %q %v", buf, err)
+	}
+}
+
+// TestI2PSourceAddr ensures every destination maps to a stable loopback
+// address of its own outside of 127.0.0.0/9.
+func TestI2PSourceAddr(t *testing.T) {
+	a := i2pSourceAddr(i2pTestDest)
+	b := i2pSourceAddr(i2pTestPeerDest)
+	_, network, _ := net.ParseCIDR("127.128.0.0/9")
+	for _, ip := range []net.IP{a, b} {
+		if !network.Contains(ip) {
+			t.Errorf("i2pSourceAddr: %v is not in %v", ip, network)
+		}
+	}
+	if a.Equal(b) {
+		t.Errorf("i2pSourceAddr: destinations share address %v", a)
+	}
+	if !a.Equal(i2pSourceAddr(i2pTestDest)) {
+		t.Errorf("i2pSourceAddr: address is not stable")
+	}
+}
+
+// TestSpliceConn ensures incoming connections are forwarded to the target
+// from the source address of their destination.
+func TestSpliceConn(t *testing.T) {
+	target, err := i2pForwardTarget([]string{"[::1]:1", "127.0.0.1:0"})
+	if err != nil {
+		t.Skipf("unable to forward I2P connections: %v", err)
+	}
+	if target != "127.0.0.1:0" {
+		t.Errorf("i2pForwardTarget: unexpected target %s", target)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	source := i2pSourceAddr(i2pTestPeerDest)
+	go spliceConn(server, l.Addr().String(), source)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %v", err)
+	}
+	defer conn.Close()
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	if !remote.IP.Equal(source) {
+		t.Errorf("unexpected source address - got %v, want %v",
+			remote.IP, source)
+	}
+
+	go io.WriteString(client, "version")
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil ||
+		string(buf) != "version" {
+
+		t.Errorf("unexpected forwarded data %q %v", buf, err)
+	}
+}
+
+// TestI2PRoutes ensures I2P peers given by --connect or --addpeer are reached
+// through the session along the connect path of the server, which resolves
+// the host of a peer to a network address and then dials either the address
+// it was given or the resolved one.
+func TestI2PRoutes(t *testing.T) {
+	samAddr, closeBridge := fakeSAMBridge(t)
+	defer closeBridge()
+	dir, err := ioutil.TempDir("", "i2p")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newI2PSession(samAddr, filepath.Join(dir, i2pKeyFilename))
+	if _, err := s.start(); err != nil {
+		t.Fatalf("start: unexpected error: %v", err)
+	}
+	defer s.Close()
+
+	var dialed, lookedUp []string
+	dial, lookup := i2pRoutes(s,
+		func(network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, io.EOF
+		},
+		func(host string) ([]net.IP, error) {
+			lookedUp = append(lookedUp, host)
+			return []net.IP{net.IPv4(10, 0, 0, 1)}, nil
+		})
+
+	addr := "peer.i2p:8333"
+	host, port, _ := net.SplitHostPort(addr)
+	ips, err := lookup(host)
+	if err != nil {
+		t.Fatalf("lookup: unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(i2pSourceAddr(i2pTestPeerDest)) {
+		t.Fatalf("lookup: unexpected addresses %v", ips)
+	}
+	resolved := net.JoinHostPort(ips[0].String(), port)
+	for _, a := range []string{addr, resolved} {
+		conn, err := dial("tcp", a)
+		if err != nil {
+			t.Errorf("dial %s: unexpected error: %v", a, err)
+			continue
+		}
+		io.WriteString(conn, "version")
+		buf := make([]byte, 7)
+		if _, err := io.ReadFull(conn, buf); err != nil ||
+			string(buf) != "version" {
+
+			t.Errorf("dial %s: unexpected echo %q %v", a, buf, err)
+		}
+		conn.Close()
+	}
+	if _, err := lookup("unknown.i2p"); err == nil {
+		t.Errorf("lookup: unexpected success for unknown host")
+	}
+
+	// Other hosts and addresses use the functions which were passed.
+	if _, err := lookup("example.com"); err != nil {
+		t.Errorf("lookup: unexpected error: %v", err)
+	}
+	dial("tcp", "10.0.0.1:8333")
+	dial("tcp", "127.128.0.1:8333")
+	if len(lookedUp) != 1 || lookedUp[0] != "example.com" {
+		t.Errorf("lookup: unexpected passed lookups %v", lookedUp)
+	}
+	if len(dialed) != 2 {
+		t.Errorf("dial: unexpected passed dials %v", dialed)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hlandau/xlog"
+)
+
+// logLevels maps the debug levels which may be specified with --debuglevel to
+// the equivalent xlog severities.
+var logLevels = map[string]xlog.Severity{
+	"trace":    xlog.SevTrace,
+	"debug":    xlog.SevDebug,
+	"info":     xlog.SevInfo,
+	"warn":     xlog.SevWarn,
+	"error":    xlog.SevError,
+	"critical": xlog.SevCritical,
+}
+
+// validLogLevel returns whether or not logLevel is a valid debug log level.
+func validLogLevel(logLevel string) bool {
+	_, ok := logLevels[logLevel]
+	return ok
+}
+
+// subsystemLoggers returns the logging sites of all subsystems keyed by their
+// subsystem identifier.  Every package which creates a logger with xlog.New
+// registers a site, so this includes the subsystems of the server packages as
+// well as those of btcd itself.
+func subsystemLoggers() map[string]xlog.Site {
+	sites := make(map[string]xlog.Site)
+	xlog.VisitSites(func(s xlog.Site) error {
+		sites[s.Name()] = s
+		return nil
+	})
+	return sites
+}
+
+// supportedSubsystems returns a sorted slice of the supported subsystems for
+// logging purposes.
+func supportedSubsystems() []string {
+	sites := subsystemLoggers()
+
+	// Convert the subsystem sites map keys to a slice.
+	subsystems := make([]string, 0, len(sites))
+	for subsysID := range sites {
+		subsystems = append(subsystems, subsysID)
+	}
+
+	// Sort the subsystems for stable display.
+	sort.Strings(subsystems)
+	return subsystems
+}
+
+// setLogLevel sets the logging level for provided subsystem.  Invalid
+// subsystems are ignored.
+func setLogLevel(subsysID string, logLevel string) {
+	site, ok := subsystemLoggers()[subsysID]
+	if !ok {
+		return
+	}
+	site.SetSeverity(logLevels[logLevel])
+}
+
+// setLogLevels sets the log level for all subsystem loggers to the passed
+// level.
+func setLogLevels(logLevel string) {
+	severity := logLevels[logLevel]
+	for _, site := range subsystemLoggers() {
+		site.SetSeverity(severity)
+	}
+}
+
+// parseDebugLevels parses the specified debug level and returns the level of
+// each subsystem it sets.  An appropriate error is returned if anything is
+// invalid.
+func parseDebugLevels(debugLevel string) (map[string]string, error) {
+	sites := subsystemLoggers()
+	levels := make(map[string]string)
+
+	// When the specified string doesn't have any delimiters, treat it as
+	// the log level for all subsystems.
+	if !strings.Contains(debugLevel, ",") && !strings.Contains(debugLevel, "=") {
+		// Validate debug log level.
+		if !validLogLevel(debugLevel) {
+			str := "The specified debug level [%v] is invalid"
+			return nil, fmt.Errorf(str, debugLevel)
+		}
+
+		for subsysID := range sites {
+			levels[subsysID] = debugLevel
+		}
+		return levels, nil
+	}
+
+	// Split the specified string into subsystem/level pairs while detecting
+	// issues.
+	for _, logLevelPair := range strings.Split(debugLevel, ",") {
+		if !strings.Contains(logLevelPair, "=") {
+			str := "The specified debug level contains an invalid " +
+				"subsystem/level pair [%v]"
+			return nil, fmt.Errorf(str, logLevelPair)
+		}
+
+		// Extract the specified subsystem and log level.
+		fields := strings.SplitN(logLevelPair, "=", 2)
+		subsysID, logLevel := fields[0], fields[1]
+
+		// Validate subsystem.
+		if _, exists := sites[subsysID]; !exists {
+			str := "The specified subsystem [%v] is invalid -- " +
+				"supported subsystems %v"
+			return nil, fmt.Errorf(str, subsysID, supportedSubsystems())
+		}
+
+		// Validate log level.
+		if !validLogLevel(logLevel) {
+			str := "The specified debug level [%v] is invalid"
+			return nil, fmt.Errorf(str, logLevel)
+		}
+
+		levels[subsysID] = logLevel
+	}
+	return levels, nil
+}
+
+// setDebugLevels sets the log level of each subsystem in the passed map, as
+// returned by parseDebugLevels.
+func setDebugLevels(levels map[string]string) {
+	for subsysID, logLevel := range levels {
+		setLogLevel(subsysID, logLevel)
+	}
+}
+
+// parseAndSetDebugLevels attempts to parse the specified debug level and set
+// the levels accordingly.  An appropriate error is returned if anything is
+// invalid, in which case the current levels are left untouched.
+func parseAndSetDebugLevels(debugLevel string) error {
+	levels, err := parseDebugLevels(debugLevel)
+	if err != nil {
+		return err
+	}
+	setDebugLevels(levels)
+	return nil
+}
+
+// handleDebugLevel handles the debuglevel RPC method, which sets the debug
+// levels as the debuglevel option does.  The level specification show lists the
+// supported subsystems instead.
+func handleDebugLevel(params []json.RawMessage) (interface{}, error) {
+	var levelSpec string
+	if len(params) != 1 || json.Unmarshal(params[0], &levelSpec) != nil {
+		return nil, &rpcError{
+			Code:    rpcErrInvalidParams,
+			Message: "debuglevel takes a level specification",
+		}
+	}
+	if levelSpec == "show" {
+		return fmt.Sprintf("Supported subsystems %v",
+			supportedSubsystems()), nil
+	}
+
+	err := parseAndSetDebugLevels(levelSpec)
+	if err != nil {
+		return nil, &rpcError{Code: rpcErrInvalidParams, Message: err.Error()}
+	}
+	return "Done.", nil
+}
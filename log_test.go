@@ -0,0 +1,112 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hlandau/xlog"
+)
+
+// testLog is the logger of a subsystem used by the debug level tests.
+var testLog, _ = xlog.New("TSTLVL")
+
+// TestHandleDebugLevel ensures the debuglevel RPC method lists the subsystems,
+// sets the levels it is passed and rejects invalid ones without changing the
+// current levels.
+func TestHandleDebugLevel(t *testing.T) {
+	var buf bytes.Buffer
+	sink := xlog.NewWriterSink(&buf)
+	xlog.RootSink.Add(sink)
+	defer xlog.RootSink.Remove(sink)
+
+	tests := []struct {
+		name    string
+		params  string
+		want    string
+		wantErr bool
+		logged  bool
+	}{
+		{
+			name:   "show",
+			params: `["show"]`,
+			want:   "Supported subsystems [",
+		},
+		{
+			name:   "subsystem level",
+			params: `["TSTLVL=trace"]`,
+			want:   "Done.",
+			logged: true,
+		},
+		{
+			name:    "unknown subsystem",
+			params:  `["TSTLVL=error,NOSUCHSUBSYS=info"]`,
+			wantErr: true,
+			logged:  true,
+		},
+		{
+			name:    "invalid level",
+			params:  `["TSTLVL=loud"]`,
+			wantErr: true,
+			logged:  true,
+		},
+		{
+			name:   "level of all subsystems",
+			params: `["error"]`,
+			want:   "Done.",
+		},
+		{
+			name:    "no level",
+			params:  `[]`,
+			wantErr: true,
+		},
+		{
+			name:    "level which is not a string",
+			params:  `[1]`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		var params []json.RawMessage
+		if err := json.Unmarshal([]byte(test.params), &params); err != nil {
+			t.Fatalf("%s: invalid params: %v", test.name, err)
+		}
+		result, err := handleDebugLevel(params)
+		if test.wantErr {
+			jsonErr, ok := err.(*rpcError)
+			if !ok || jsonErr.Code != rpcErrInvalidParams {
+				t.Errorf("%s: unexpected error - got %v, want "+
+					"invalid params", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if s, _ := result.(string); !strings.HasPrefix(s, test.want) {
+			t.Errorf("%s: unexpected result - got %v, want %s",
+				test.name, result, test.want)
+		}
+		if test.name == "show" && !strings.Contains(result.(string),
+			"TSTLVL") {
+
+			t.Errorf("%s: subsystem not listed in %v", test.name,
+				result)
+		}
+
+		// Trace messages of the test subsystem are only logged once
+		// its level is set to trace.
+		if test.name == "show" {
+			continue
+		}
+		buf.Reset()
+		testLog.Tracef("trace message")
+		if logged := strings.Contains(buf.String(), "trace message"); logged != test.logged {
+			t.Errorf("%s: unexpected trace logging - got %v, want %v",
+				test.name, logged, test.logged)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package logformat provides log sinks for xlog which write either the usual
+// text output or one JSON object per line, as selected with SetFormat.  It is
+// shared by btcd and the utilities so they all honor --logformat in the same
+// way.
+package logformat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hlandau/xlog"
+)
+
+const (
+	// Text selects the plain text output of xlog.
+	Text = "text"
+
+	// JSON selects one JSON object per line.
+	JSON = "json"
+)
+
+// Formats contains the names of all supported log formats.
+var Formats = []string{Text, JSON}
+
+var (
+	format      atomic.Value
+	stderrOnce  sync.Once
+	stderrSink  xlog.Sink
+	reservedKey = map[string]bool{
+		"timestamp": true,
+		"severity":  true,
+		"subsystem": true,
+		"message":   true,
+	}
+)
+
+func init() {
+	format.Store(Text)
+}
+
+// Valid returns whether the passed name is a supported log format.
+func Valid(name string) bool {
+	for _, f := range Formats {
+		if name == f {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFormat selects the format written by all sinks created by this package.
+// The first call also replaces the default xlog stderr sink with one of them,
+// so console output follows the selected format as well.
+func SetFormat(name string) error {
+	if !Valid(name) {
+		return fmt.Errorf("unknown log format %q -- supported formats %v",
+			name, Formats)
+	}
+	format.Store(name)
+
+	stderrOnce.Do(func() {
+		stderrSink = NewSink(os.Stderr)
+		xlog.RootSink.Remove(xlog.StderrSink)
+		xlog.RootSink.Add(stderrSink)
+	})
+	return nil
+}
+
+// Field is a log parameter carrying a key so the JSON format can include it
+// as a separate member of the object.  In messages it formats exactly like
+// its value, so fields can be passed to the usual Infof style functions.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field with the passed key and value.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Format formats the value of the field with the passed verb and flags.
+func (f Field) Format(s fmt.State, verb rune) {
+	directive := "%"
+	for _, flag := range "+-# 0" {
+		if s.Flag(int(flag)) {
+			directive += string(flag)
+		}
+	}
+	if width, ok := s.Width(); ok {
+		directive += strconv.Itoa(width)
+	}
+	if prec, ok := s.Precision(); ok {
+		directive += "." + strconv.Itoa(prec)
+	}
+	fmt.Fprintf(s, directive+string(verb), f.Value)
+}
+
+// sink writes log messages to a writer in the currently selected format.
+type sink struct {
+	mtx  sync.Mutex
+	w    io.Writer
+	text xlog.Sink
+}
+
+// NewSink returns a sink which writes log messages to w in the format selected
+// with SetFormat at the time each message is logged.
+func NewSink(w io.Writer) xlog.Sink {
+	return &sink{w: w, text: xlog.NewWriterSink(w)}
+}
+
+// ReceiveLocally implements xlog.Sink.
+func (s *sink) ReceiveLocally(sev xlog.Severity, f string, params ...interface{}) {
+	s.ReceiveFromChild(sev, f, params...)
+}
+
+// ReceiveFromChild implements xlog.Sink.
+func (s *sink) ReceiveFromChild(sev xlog.Severity, f string, params ...interface{}) {
+	if format.Load().(string) != JSON {
+		s.text.ReceiveFromChild(sev, f, params...)
+		return
+	}
+
+	// Messages from subsystem loggers arrive prefixed with the name of the
+	// subsystem.
+	var subsystem string
+	if i := strings.Index(f, ": "); i > 0 && !strings.ContainsAny(f[:i], " %") {
+		subsystem, f = f[:i], f[i+2:]
+	}
+
+	obj := map[string]interface{}{
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"severity":  strings.ToLower(sev.String()),
+		"subsystem": subsystem,
+		"message":   fmt.Sprintf(f, params...),
+	}
+	for _, param := range params {
+		field, ok := param.(Field)
+		if !ok || reservedKey[field.Key] {
+			continue
+		}
+		switch v := field.Value.(type) {
+		case error:
+			obj[field.Key] = v.Error()
+		case fmt.Stringer:
+			obj[field.Key] = v.String()
+		default:
+			obj[field.Key] = v
+		}
+	}
+
+	line, err := json.Marshal(obj)
+	if err != nil {
+		return
+	}
+	s.mtx.Lock()
+	s.w.Write(append(line, '\n'))
+	s.mtx.Unlock()
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hlandau/xlog"
+	"github.com/hlandauf/btcd/logformat"
+)
+
+const (
+	// logRotateInterval is the maximum age of the log file before it is
+	// rotated regardless of its size.
+	logRotateInterval = time.Hour * 24
+
+	// logRotateTimeFormat is the format of the timestamp appended to the
+	// names of rotated log files.
+	logRotateTimeFormat = "20060102-150405.000"
+)
+
+// logRotator is an io.Writer which writes to a log file and rotates it once
+// it grows beyond the maximum size or becomes older than logRotateInterval.
+// Rotated files are compressed with gzip and only the most recent ones are
+// kept.
+type logRotator struct {
+	mtx      sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	opened   time.Time
+	wg       sync.WaitGroup
+}
+
+// logFile is the rotator to which log output is written once file logging is
+// initialized.
+var logFile *logRotator
+
+// initLogRotator initializes logging to the passed log file in addition to
+// the console.  Rotation happens once the file grows beyond maxSize megabytes
+// and at most maxFiles rotated files are kept, or all of them when it is zero.
+// Calling it again only updates the rotation limits since the file can't be
+// moved while the process is running.
+func initLogRotator(path string, maxSize, maxFiles int) error {
+	if logFile != nil {
+		logFile.setLimits(maxSize, maxFiles)
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	r := &logRotator{path: path}
+	r.setLimits(maxSize, maxFiles)
+	err = r.open()
+	if err != nil {
+		return err
+	}
+
+	logFile = r
+	xlog.RootSink.Add(logformat.NewSink(r))
+	return nil
+}
+
+// setLimits sets the maximum size in megabytes and the number of rotated files
+// to keep.
+func (r *logRotator) setLimits(maxSize, maxFiles int) {
+	r.mtx.Lock()
+	r.maxSize = int64(maxSize) * 1024 * 1024
+	r.maxFiles = maxFiles
+	r.mtx.Unlock()
+}
+
+// open opens the log file for appending.  The age of the file is measured from
+// its modification time so restarts do not postpone rotation indefinitely.
+func (r *logRotator) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file, r.size, r.opened = file, fi.Size(), time.Now()
+	if fi.Size() > 0 {
+		r.opened = fi.ModTime()
+	}
+	return nil
+}
+
+// Write writes the passed data to the log file, rotating it first when
+// needed.
+func (r *logRotator) Write(b []byte) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.size > 0 && (r.size+int64(len(b)) > r.maxSize ||
+		time.Since(r.opened) > logRotateInterval) {
+
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current log file aside, opens a new one and compresses the
+// old file in the background.  It must be called with the mutex held.
+func (r *logRotator) rotate() error {
+	r.file.Close()
+	rotated := r.path + "." + time.Now().Format(logRotateTimeFormat)
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", r.path,
+			time.Now().Format(logRotateTimeFormat), i)
+	}
+	err := os.Rename(r.path, rotated)
+	if err != nil {
+		// Keep writing to the current file rather than losing the
+		// output.
+		if oerr := r.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	err = r.open()
+	if err != nil {
+		return err
+	}
+
+	maxFiles := r.maxFiles
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if err := compressLogFile(rotated); err != nil {
+			log.Warnf("Unable to compress log file %s: %v", rotated,
+				err)
+		}
+		pruneLogFiles(r.path, maxFiles)
+	}()
+	return nil
+}
+
+// Close waits for pending compressions to finish and closes the log file.
+func (r *logRotator) Close() error {
+	r.wg.Wait()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.file.Close()
+}
+
+// compressLogFile replaces the passed file with a gzip compressed copy whose
+// name has a .gz suffix.
+func compressLogFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedLogFile is a compressed rotation of a log file.
+type rotatedLogFile struct {
+	name string
+	time time.Time
+	seq  int
+}
+
+// byRotation implements sort.Interface to sort rotated log files by the time of
+// their rotation, and those within the same millisecond by sequence number.
+type byRotation []*rotatedLogFile
+
+func (s byRotation) Len() int      { return len(s) }
+func (s byRotation) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byRotation) Less(i, j int) bool {
+	if !s[i].time.Equal(s[j].time) {
+		return s[i].time.Before(s[j].time)
+	}
+	return s[i].seq < s[j].seq
+}
+
+// parseRotatedLogFile parses the name of a compressed rotation of the passed
+// log file, which is the name of the log file followed by the time of the
+// rotation and, when there was more than one rotation within a millisecond, a
+// sequence number.  It returns false for names of any other form.
+func parseRotatedLogFile(path, name string) (*rotatedLogFile, bool) {
+	prefix := path + "."
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".gz") {
+		return nil, false
+	}
+	rest := strings.TrimSuffix(name[len(prefix):], ".gz")
+	if len(rest) < len(logRotateTimeFormat) {
+		return nil, false
+	}
+	t, err := time.ParseInLocation(logRotateTimeFormat,
+		rest[:len(logRotateTimeFormat)], time.Local)
+	if err != nil {
+		return nil, false
+	}
+
+	f := &rotatedLogFile{name: name, time: t}
+	if rest = rest[len(logRotateTimeFormat):]; rest != "" {
+		if !strings.HasPrefix(rest, "-") {
+			return nil, false
+		}
+		f.seq, err = strconv.Atoi(rest[1:])
+		if err != nil || f.seq <= 0 {
+			return nil, false
+		}
+	}
+	return f, true
+}
+
+// pruneLogFiles removes the oldest compressed rotations of the passed log file
+// so at most maxFiles of them remain.  Nothing is removed when maxFiles is
+// zero.
+func pruneLogFiles(path string, maxFiles int) {
+	if maxFiles <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(path + ".*.gz")
+	if err != nil {
+		return
+	}
+	var files []*rotatedLogFile
+	for _, name := range matches {
+		if f, ok := parseRotatedLogFile(path, name); ok {
+			files = append(files, f)
+		}
+	}
+	if len(files) <= maxFiles {
+		return
+	}
+
+	sort.Sort(byRotation(files))
+	for _, f := range files[:len(files)-maxFiles] {
+		if err := os.Remove(f.name); err != nil {
+			log.Warnf("Unable to remove old log file %s: %v", f.name,
+				err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestPruneLogFiles ensures the oldest rotations are removed, including when
+// several rotations happened within the same millisecond, and that files
+// which are not rotations of the log file are left alone.
+func TestPruneLogFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string
+		maxFiles int
+		want     []string
+	}{
+		{
+			name: "different times",
+			files: []string{
+				"btcd.log.20140102-030405.006.gz",
+				"btcd.log.20140102-030405.007.gz",
+				"btcd.log.20140102-030406.000.gz",
+			},
+			maxFiles: 2,
+			want: []string{
+				"btcd.log.20140102-030405.007.gz",
+				"btcd.log.20140102-030406.000.gz",
+			},
+		},
+		{
+			name: "two rotations in the same millisecond",
+			files: []string{
+				"btcd.log.20140102-030405.006.gz",
+				"btcd.log.20140102-030405.006-1.gz",
+			},
+			maxFiles: 1,
+			want:     []string{"btcd.log.20140102-030405.006-1.gz"},
+		},
+		{
+			name: "many rotations in the same millisecond",
+			files: []string{
+				"btcd.log.20140102-030405.006.gz",
+				"btcd.log.20140102-030405.006-1.gz",
+				"btcd.log.20140102-030405.006-2.gz",
+				"btcd.log.20140102-030405.006-10.gz",
+				"btcd.log.20140102-030405.005-11.gz",
+			},
+			maxFiles: 2,
+			want: []string{
+				"btcd.log.20140102-030405.006-10.gz",
+				"btcd.log.20140102-030405.006-2.gz",
+			},
+		},
+		{
+			name: "other files",
+			files: []string{
+				"btcd.log.20140102-030405.006.gz",
+				"btcd.log.20140102-030405.007.gz",
+				"btcd.log.backup.gz",
+				"btcd.log.20140102-030405.006-x.gz",
+				"btcd.log.20140102-030405.006",
+			},
+			maxFiles: 1,
+			want: []string{
+				"btcd.log.20140102-030405.006",
+				"btcd.log.20140102-030405.006-x.gz",
+				"btcd.log.20140102-030405.007.gz",
+				"btcd.log.backup.gz",
+			},
+		},
+		{
+			name: "all files kept",
+			files: []string{
+				"btcd.log.20140102-030405.006.gz",
+				"btcd.log.20140102-030405.006-1.gz",
+			},
+			maxFiles: 0,
+			want: []string{
+				"btcd.log.20140102-030405.006-1.gz",
+				"btcd.log.20140102-030405.006.gz",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "logrotate")
+		if err != nil {
+			t.Fatalf("unable to create temp dir: %v", err)
+		}
+		for _, name := range test.files {
+			err := ioutil.WriteFile(filepath.Join(dir, name), nil,
+				0600)
+			if err != nil {
+				os.RemoveAll(dir)
+				t.Fatalf("unable to create log file: %v", err)
+			}
+		}
+
+		pruneLogFiles(filepath.Join(dir, "btcd.log"), test.maxFiles)
+		var got []string
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			got = append(got, info.Name())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: unexpected files - got %v, want %v",
+				test.name, got, test.want)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package nmcnet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/hlandauf/btcchain"
+	"github.com/hlandauf/btcnet"
+	"github.com/hlandauf/btcwire"
+)
+
+// validNetworkName matches the names a network parameters file may give its
+// network.  The name is used as the name of the data and log subdirectories of
+// the network, so it is restricted to characters which are safe there.
+var validNetworkName = regexp.MustCompile("^[a-z0-9_-]+$")
+
+// reservedNetworkNames returns the names a network parameters file may not give
+// its network since they are those of built-in networks, or of their data
+// directories or config file sections.
+func reservedNetworkNames() map[string]struct{} {
+	names := map[string]struct{}{
+		"mainnet": {},
+		"testnet": {},
+		"regtest": {},
+		"simnet":  {},
+	}
+	for _, params := range []*btcnet.Params{
+		&btcnet.MainNetParams,
+		&btcnet.TestNet3Params,
+		&btcnet.RegressionNetParams,
+		&btcnet.SimNetParams,
+		&btcnet.NmcMainNetParams,
+		&TestNetParams,
+		&RegressionNetParams,
+	} {
+		names[params.Name] = struct{}{}
+	}
+	return names
+}
+
+// fileGenesis describes the genesis block in a network parameters file.  The
+// coinbase transaction is given in serialized hex form.  When it is omitted,
+// the coinbase of the Namecoin main network genesis block is used.  The
+// merkle root defaults to the hash of the coinbase transaction.  The hash of
+// the block is optional.  When given, it must match the hash of the described
+// block, which catches mistakes in the description.
+type fileGenesis struct {
+	Hash       string `json:"hash"`
+	Version    int32  `json:"version"`
+	PrevBlock  string `json:"prevblock"`
+	MerkleRoot string `json:"merkleroot"`
+	Timestamp  int64  `json:"timestamp"`
+	Bits       uint32 `json:"bits"`
+	Nonce      uint32 `json:"nonce"`
+	Coinbase   string `json:"coinbase"`
+}
+
+// fileCheckpoint describes a checkpoint in a network parameters file.
+type fileCheckpoint struct {
+	Height int64  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// paramsFile is the layout of a network parameters file.  Byte strings such as
+// hashes and the HD key prefixes are hex encoded.  Hashes are in the usual
+// big-endian byte order.  The address and key prefixes, and the subsidy halving
+// interval, default to those of the Namecoin main network.
+type paramsFile struct {
+	Name                   string           `json:"name"`
+	Net                    uint32           `json:"net"`
+	DefaultPort            string           `json:"defaultport"`
+	RPCPort                string           `json:"rpcport"`
+	DNSSeeds               []string         `json:"dnsseeds"`
+	Genesis                fileGenesis      `json:"genesis"`
+	PowLimitBits           uint32           `json:"powlimitbits"`
+	SubsidyHalvingInterval int32            `json:"subsidyhalvinginterval"`
+	ResetMinDifficulty     bool             `json:"resetmindifficulty"`
+	Checkpoints            []fileCheckpoint `json:"checkpoints"`
+	RelayNonStdTxs         bool             `json:"relaynonstdtxs"`
+	PubKeyHashAddrID       *byte            `json:"pubkeyhashaddrid"`
+	ScriptHashAddrID       *byte            `json:"scripthashaddrid"`
+	PrivateKeyID           *byte            `json:"privatekeyid"`
+	HDPrivateKeyID         string           `json:"hdprivatekeyid"`
+	HDPublicKeyID          string           `json:"hdpublickeyid"`
+}
+
+// LoadParamsFile reads network parameters from the passed JSON file and
+// registers them with btcnet so addresses for the network can be decoded.
+// Networks whose message start string is already registered, such as private
+// chains reusing the regression test one, are accepted as well.
+func LoadParamsFile(path string) (*btcnet.Params, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pf paramsFile
+	if err := json.Unmarshal(b, &pf); err != nil {
+		return nil, err
+	}
+
+	params, err := pf.params()
+	if err != nil {
+		return nil, err
+	}
+	err = btcnet.Register(params)
+	if err != nil && err != btcnet.ErrDuplicateNet {
+		return nil, err
+	}
+	return params, nil
+}
+
+// params builds the network parameters described by the file.
+func (pf *paramsFile) params() (*btcnet.Params, error) {
+	switch {
+	case pf.Name == "":
+		return nil, errors.New("missing network name")
+	case !validNetworkName.MatchString(pf.Name):
+		return nil, fmt.Errorf("invalid network name %q -- names may "+
+			"only contain lowercase letters, digits, _ and -", pf.Name)
+	case pf.Net == 0:
+		return nil, errors.New("missing network magic")
+	case pf.DefaultPort == "":
+		return nil, errors.New("missing default port")
+	case pf.RPCPort == "":
+		return nil, errors.New("missing RPC port")
+	case pf.PowLimitBits == 0:
+		return nil, errors.New("missing proof of work limit")
+	}
+
+	if _, ok := reservedNetworkNames()[pf.Name]; ok {
+		return nil, fmt.Errorf("network name %q is that of a built-in "+
+			"network", pf.Name)
+	}
+
+	genesis, err := pf.Genesis.block()
+	if err != nil {
+		return nil, fmt.Errorf("invalid genesis block: %v", err)
+	}
+	genesisHash, err := genesis.Header.BlockSha()
+	if err != nil {
+		return nil, fmt.Errorf("invalid genesis block: %v", err)
+	}
+	if pf.Genesis.Hash != "" {
+		hash, err := btcwire.NewShaHashFromStr(pf.Genesis.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid genesis block hash: %v",
+				err)
+		}
+		if !hash.IsEqual(&genesisHash) {
+			return nil, fmt.Errorf("genesis block hash mismatch -- "+
+				"computed %v, file specifies %v", genesisHash, hash)
+		}
+	}
+
+	var checkpoints []btcnet.Checkpoint
+	for _, c := range pf.Checkpoints {
+		hash, err := btcwire.NewShaHashFromStr(c.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkpoint at height "+
+				"%d: %v", c.Height, err)
+		}
+		checkpoints = append(checkpoints, btcnet.Checkpoint{
+			Height: c.Height,
+			Hash:   hash,
+		})
+	}
+
+	// Start from the Namecoin main network so any parameter which is not
+	// set in the file keeps a sensible value.
+	params := btcnet.NmcMainNetParams
+	if pf.HDPrivateKeyID != "" {
+		params.HDPrivateKeyID, err = parseKeyID(pf.HDPrivateKeyID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HD private key ID: %v",
+				err)
+		}
+	}
+	if pf.HDPublicKeyID != "" {
+		params.HDPublicKeyID, err = parseKeyID(pf.HDPublicKeyID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HD public key ID: %v",
+				err)
+		}
+	}
+	if pf.PubKeyHashAddrID != nil {
+		params.PubKeyHashAddrID = *pf.PubKeyHashAddrID
+	}
+	if pf.ScriptHashAddrID != nil {
+		params.ScriptHashAddrID = *pf.ScriptHashAddrID
+	}
+	if pf.PrivateKeyID != nil {
+		params.PrivateKeyID = *pf.PrivateKeyID
+	}
+	params.Name = pf.Name
+	params.Net = btcwire.BitcoinNet(pf.Net)
+	params.DefaultPort = pf.DefaultPort
+	params.RPCPort = pf.RPCPort
+	params.DNSSeeds = pf.DNSSeeds
+	params.GenesisBlock = genesis
+	params.GenesisHash = &genesisHash
+	params.PowLimit = btcchain.CompactToBig(pf.PowLimitBits)
+	params.PowLimitBits = pf.PowLimitBits
+	if pf.SubsidyHalvingInterval != 0 {
+		params.SubsidyHalvingInterval = pf.SubsidyHalvingInterval
+	}
+	params.ResetMinDifficulty = pf.ResetMinDifficulty
+	params.Checkpoints = checkpoints
+	params.RelayNonStdTxs = pf.RelayNonStdTxs
+	return &params, nil
+}
+
+// block builds the genesis block described by the file.
+func (g *fileGenesis) block() (*btcwire.MsgBlock, error) {
+	var coinbase *btcwire.MsgTx
+	if g.Coinbase == "" {
+		coinbase = btcnet.NmcMainNetParams.GenesisBlock.Transactions[0]
+	} else {
+		b, err := hex.DecodeString(g.Coinbase)
+		if err != nil {
+			return nil, err
+		}
+		coinbase = new(btcwire.MsgTx)
+		err = coinbase.Deserialize(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var merkleRoot btcwire.ShaHash
+	if g.MerkleRoot == "" {
+		// The merkle root of a block with a single transaction is the
+		// hash of that transaction.
+		txHash, err := coinbase.TxSha()
+		if err != nil {
+			return nil, err
+		}
+		merkleRoot = txHash
+	} else {
+		hash, err := btcwire.NewShaHashFromStr(g.MerkleRoot)
+		if err != nil {
+			return nil, err
+		}
+		merkleRoot = *hash
+	}
+
+	var prevBlock btcwire.ShaHash
+	if g.PrevBlock != "" {
+		hash, err := btcwire.NewShaHashFromStr(g.PrevBlock)
+		if err != nil {
+			return nil, err
+		}
+		prevBlock = *hash
+	}
+
+	if g.Bits == 0 {
+		return nil, errors.New("missing difficulty bits")
+	}
+	version := g.Version
+	if version == 0 {
+		version = 1
+	}
+
+	return &btcwire.MsgBlock{
+		Header: btcwire.BlockHeader{
+			Version:    version,
+			PrevBlock:  prevBlock,
+			MerkleRoot: merkleRoot,
+			Timestamp:  time.Unix(g.Timestamp, 0),
+			Bits:       g.Bits,
+			Nonce:      g.Nonce,
+		},
+		Transactions: []*btcwire.MsgTx{coinbase},
+	}, nil
+}
+
+// parseKeyID decodes a hex encoded four byte HD key version prefix.
+func parseKeyID(s string) ([4]byte, error) {
+	var id [4]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != len(id) {
+		return id, fmt.Errorf("length is %d bytes instead of %d", len(b),
+			len(id))
+	}
+	copy(id[:], b)
+	return id, nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package nmcnet
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hlandauf/btcnet"
+)
+
+// testParamsFile returns a network parameters file with the passed name and
+// genesis block hash.  Its genesis block header is that of the Namecoin test
+// network, whose hash is testGenesisHash.
+func testParamsFile(name, hash string) string {
+	return `{
+		"name": "` + name + `",
+		"net": 3735928559,
+		"defaultport": "28444",
+		"rpcport": "28443",
+		"genesis": {
+			"hash": "` + hash + `",
+			"version": 1,
+			"merkleroot": "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b",
+			"timestamp": 1296688602,
+			"bits": 487063544,
+			"nonce": 384568319
+		},
+		"powlimitbits": 486604799
+	}`
+}
+
+// testGenesisHash is the hash of the genesis block of testParamsFile.
+const testGenesisHash = "00000007199508e34a9ff81e6ec0c477a4cccff2a4767a8eee39c11db367b008"
+
+// TestLoadParamsFile ensures valid network parameters files are loaded and that
+// files with an invalid name or genesis block hash are rejected.
+func TestLoadParamsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nmcnet")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		err     string // substring of the expected error, if any
+	}{
+		{
+			name:    "valid",
+			content: testParamsFile("privnet", testGenesisHash),
+		},
+		{
+			name:    "valid without hash",
+			content: testParamsFile("privnet-2", ""),
+		},
+		{
+			name:    "mismatched genesis hash",
+			content: testParamsFile("privnet", strings.Repeat("0", 64)),
+			err:     "genesis block hash mismatch",
+		},
+		{
+			name:    "invalid genesis hash",
+			content: testParamsFile("privnet", "xyz"),
+			err:     "invalid genesis block hash",
+		},
+		{
+			name:    "missing name",
+			content: testParamsFile("", testGenesisHash),
+			err:     "missing network name",
+		},
+		{
+			name:    "uppercase name",
+			content: testParamsFile("PrivNet", testGenesisHash),
+			err:     "invalid network name",
+		},
+		{
+			name:    "path in name",
+			content: testParamsFile("../mainnet", testGenesisHash),
+			err:     "invalid network name",
+		},
+		{
+			name:    "data directory name",
+			content: testParamsFile("testnet", testGenesisHash),
+			err:     "built-in network",
+		},
+		{
+			name: "main network name",
+			content: testParamsFile(btcnet.NmcMainNetParams.Name,
+				testGenesisHash),
+			err: "built-in network",
+		},
+		{
+			name:    "Namecoin test network name",
+			content: testParamsFile(TestNetParams.Name, testGenesisHash),
+			err:     "built-in network",
+		},
+	}
+
+	// The proof of work limit of the file is 0xffff * 2^208.
+	powLimit := new(big.Int).Lsh(big.NewInt(0xffff), 208)
+
+	for _, test := range tests {
+		path := filepath.Join(dir, "params.json")
+		err := ioutil.WriteFile(path, []byte(test.content), 0600)
+		if err != nil {
+			t.Fatalf("unable to write params file: %v", err)
+		}
+
+		params, err := LoadParamsFile(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: unexpected error - got %v, want %q",
+					test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if params.GenesisHash.String() != testGenesisHash {
+			t.Errorf("%s: unexpected genesis hash - got %v, want %v",
+				test.name, params.GenesisHash, testGenesisHash)
+		}
+		if params.PowLimit.Cmp(powLimit) != 0 {
+			t.Errorf("%s: unexpected proof of work limit - got %x, "+
+				"want %x", test.name, params.PowLimit, powLimit)
+		}
+	}
+}
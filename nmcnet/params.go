@@ -0,0 +1,87 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// Package nmcnet defines the network parameters of the Namecoin test networks.
+// The Namecoin main network parameters are provided by btcnet as
+// NmcMainNetParams.  The parameters defined here are shared by btcd and the
+// utilities so they select the same networks for --testnet and --regtest.
+//
+// btcnet.Params has no field for the height at which the name rules activate,
+// so the parameters defined here can't set one.  They only differ from their
+// Bitcoin counterparts in the fields btcnet provides.
+package nmcnet
+
+import (
+	"math/big"
+
+	"github.com/hlandauf/btcnet"
+	"github.com/hlandauf/btcwire"
+)
+
+// TestNet is the message start string of the Namecoin test network.
+const TestNet btcwire.BitcoinNet = 0xfeb5bffa
+
+// testNetPowLimit is the highest proof of work value a block can have on the
+// Namecoin test network.  It is the value 2^228 - 1.
+var testNetPowLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 228),
+	big.NewInt(1))
+
+// testNetGenesisBlock is the genesis block of the Namecoin test network.  It
+// has the same coinbase and timestamp as the genesis block of the Bitcoin
+// test network, but a lower difficulty and therefore a different nonce.
+var testNetGenesisBlock = func() btcwire.MsgBlock {
+	block := *btcnet.TestNet3Params.GenesisBlock
+	block.Header.Bits = 0x1d07fff8
+	block.Header.Nonce = 0x16ec0bff
+	return block
+}()
+
+// TestNetParams defines the network parameters for the Namecoin test network.
+var TestNetParams = func() btcnet.Params {
+	params := btcnet.TestNet3Params
+	params.Name = "nmctestnet"
+	params.Net = TestNet
+	params.DefaultPort = "18334"
+	params.RPCPort = "18336"
+	params.GenesisBlock = &testNetGenesisBlock
+	params.GenesisHash = newHashFromStr("00000007199508e34a9ff81e6ec0c477" +
+		"a4cccff2a4767a8eee39c11db367b008")
+	params.PowLimit = testNetPowLimit
+	params.PowLimitBits = 0x1d0fffff
+	params.Checkpoints = nil
+	params.DNSSeeds = nil
+	return params
+}()
+
+// RegressionNetParams defines the network parameters for a private Namecoin
+// regression test network.  It uses the same message start string, genesis
+// block and proof of work limit as the Bitcoin regression test network.
+var RegressionNetParams = func() btcnet.Params {
+	params := btcnet.RegressionNetParams
+	params.Name = "nmcregtest"
+	params.DefaultPort = "18445"
+	params.RPCPort = "18443"
+	return params
+}()
+
+// newHashFromStr converts the passed big-endian hex string into a
+// btcwire.ShaHash.  It only differs from the one available in btcwire in that
+// it panics on an error since it will only (and must only) be called with
+// hard-coded, and therefore known good, hashes.
+func newHashFromStr(hexStr string) *btcwire.ShaHash {
+	sha, err := btcwire.NewShaHashFromStr(hexStr)
+	if err != nil {
+		panic(err)
+	}
+	return sha
+}
+
+func init() {
+	// The Namecoin regression test network shares its message start string
+	// with the Bitcoin one, which btcnet already registers along with the
+	// test network address prefixes used by both.
+	if err := btcnet.Register(&TestNetParams); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	socks "github.com/conformal/go-socks"
+)
+
+// dialFunc is the signature of the dial functions used by the server to make
+// outbound connections.
+type dialFunc func(network, addr string) (net.Conn, error)
+
+// proxyRoute is a single rule of a proxy routing table.  Exactly one of ipNet,
+// suffix and isDefault is set.
+type proxyRoute struct {
+	ipNet     *net.IPNet
+	suffix    string
+	isDefault bool
+	dial      dialFunc
+	lookup    lookupFunc
+}
+
+// matchHost returns whether the passed host, which is either an IP address or
+// a hostname, is matched by the route.
+func (r *proxyRoute) matchHost(host string) bool {
+	if r.ipNet != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.ipNet.Contains(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == r.suffix[1:] || strings.HasSuffix(host, r.suffix)
+}
+
+// proxyRouter selects how to dial and resolve each destination from a table
+// of routing rules.  Rules are tried in the order they were specified and the
+// first match wins.  Destinations which no rule matches use the default rule,
+// if any, and otherwise the dial and lookup functions the router was created
+// with.
+type proxyRouter struct {
+	routes []*proxyRoute
+	dial   dialFunc
+	lookup lookupFunc
+}
+
+// newProxyRouter returns a new proxyRouter for the passed rules.  Each rule is
+// of the form <match>:<target> where match is an IP network in CIDR notation
+// (IPv6 networks are enclosed in brackets), a domain suffix such as *.onion,
+// or default, and target is direct, socks5://[user:pass@]host:port,
+// http://[user:pass@]host:port or a plain host:port of a SOCKS5 proxy.
+func newProxyRouter(cfg *config, rules []string, dial dialFunc, lookup lookupFunc) (*proxyRouter, error) {
+	router := &proxyRouter{dial: dial, lookup: lookup}
+	for _, rule := range rules {
+		route, err := parseProxyRoute(cfg, rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy route [%v]: %v",
+				redactProxyRoute(rule), err)
+		}
+		if route.isDefault {
+			router.dial, router.lookup = route.dial, route.lookup
+			continue
+		}
+		router.routes = append(router.routes, route)
+	}
+	return router, nil
+}
+
+// splitProxyRoute splits a proxy routing rule into its match and target.
+func splitProxyRoute(rule string) (match, target string, err error) {
+	if strings.HasPrefix(rule, "[") {
+		end := strings.Index(rule, "]:")
+		if end < 0 {
+			return "", "", errors.New("missing closing bracket")
+		}
+		return rule[1:end], rule[end+2:], nil
+	}
+	i := strings.Index(rule, ":")
+	if i < 0 {
+		return "", "", errors.New("missing target")
+	}
+	return rule[:i], rule[i+1:], nil
+}
+
+// redactProxyRoute returns the passed proxy routing rule with the password of
+// its target, if any, redacted so the rule can be shown.
+func redactProxyRoute(rule string) string {
+	_, target, err := splitProxyRoute(rule)
+	if err != nil {
+		return rule
+	}
+	return rule[:len(rule)-len(target)] + redactURLPassword(target)
+}
+
+// parseProxyRoute parses a single proxy routing rule.
+func parseProxyRoute(cfg *config, rule string) (*proxyRoute, error) {
+	match, target, err := splitProxyRoute(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	route := &proxyRoute{}
+	switch {
+	case match == "default":
+		route.isDefault = true
+	case strings.HasPrefix(match, "*."):
+		route.suffix = strings.ToLower(match[1:])
+	case strings.Contains(match, "/"):
+		_, ipNet, err := net.ParseCIDR(match)
+		if err != nil {
+			return nil, err
+		}
+		route.ipNet = ipNet
+	default:
+		return nil, fmt.Errorf("unrecognized destination %q", match)
+	}
+
+	route.dial, route.lookup, err = parseProxyTarget(cfg, target)
+	if err != nil {
+		return nil, err
+	}
+	return route, nil
+}
+
+// parseProxyTarget returns the dial and lookup functions for the target of a
+// proxy routing rule.  Lookups through SOCKS5 proxies use Tor's RESOLVE
+// extension unless --noonion is specified, while lookups for direct and HTTP
+// proxy routes use the system resolver since HTTP proxies can't resolve names
+// on our behalf.
+func parseProxyTarget(cfg *config, target string) (dialFunc, lookupFunc, error) {
+	if target == "direct" {
+		return net.Dial, net.LookupIP, nil
+	}
+
+	if !strings.Contains(target, "://") {
+		target = "socks5://" + target
+	}
+	u, err := parseProxyURL(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Host == "" {
+		return nil, nil, errors.New("missing proxy address")
+	}
+	var username, password string
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		proxy := newTorProxy(&socks.Proxy{
+			Addr:     u.Host,
+			Username: username,
+			Password: password,
+		}, cfg.TorIsolation)
+		if cfg.NoOnion {
+			return proxy.Dial, net.LookupIP, nil
+		}
+		return proxy.Dial, newTorResolver(proxy,
+			cfg.ProxyTimeout).LookupIP, nil
+
+	case "http":
+		proxy, err := newHTTPProxy(target, "", "")
+		if err != nil {
+			return nil, nil, err
+		}
+		return proxy.Dial, net.LookupIP, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported proxy type %q", u.Scheme)
+}
+
+// route returns the route matching the passed host or nil if no rule other
+// than the default one matches it.
+func (r *proxyRouter) route(host string) *proxyRoute {
+	for _, route := range r.routes {
+		if route.matchHost(host) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Dial connects to the passed address using the route selected for its host.
+func (r *proxyRouter) Dial(network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if route := r.route(host); route != nil {
+		return route.dial(network, addr)
+	}
+	return r.dial(network, addr)
+}
+
+// LookupIP resolves the passed host using the route selected for it.
+func (r *proxyRouter) LookupIP(host string) ([]net.IP, error) {
+	if route := r.route(host); route != nil {
+		return route.lookup(host)
+	}
+	return r.lookup(host)
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/hlandauf/btcd/logformat"
+)
+
+// runtimeOptions contains the names of the configuration fields which
+// reloadConfig applies while running.  They are either only used by btcd
+// itself, or, for the added peers, applied through the RPC server, so they can
+// change without synchronizing with the server.  Changes to any other option
+// only take effect after a restart, since the server offers no way to change
+// them while it runs.
+var runtimeOptions = map[string]struct{}{
+	"AddPeers":    {},
+	"DebugLevel":  {},
+	"LogMaxSize":  {},
+	"LogMaxFiles": {},
+	"LogFormat":   {},
+	"RPCAuth":     {},
+}
+
+// reloadResult describes the outcome of a configuration reload.
+type reloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartrequired"`
+}
+
+// reloadMtx serializes configuration reloads.
+var reloadMtx sync.Mutex
+
+// changedOptions appends the long names of all options whose values differ
+// between the passed config structs, skipping the fields in runtimeOptions, to
+// the passed slice and returns it.  Nested structs are compared field by field
+// in the same way they are parsed.
+func changedOptions(changed []string, cur, next reflect.Value) []string {
+	t := cur.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if _, ok := runtimeOptions[field.Name]; ok {
+			continue
+		}
+
+		long := field.Tag.Get("long")
+		if long == "" {
+			if field.Type.Kind() == reflect.Struct {
+				changed = changedOptions(changed, cur.Field(i),
+					next.Field(i))
+			}
+			continue
+		}
+		if !reflect.DeepEqual(cur.Field(i).Interface(),
+			next.Field(i).Interface()) {
+
+			changed = append(changed, long)
+		}
+	}
+	return changed
+}
+
+// reloadConfig reloads the configuration file and command line options, and
+// applies the settings in runtimeOptions.  The running configuration, which
+// the server reads from, is left untouched.  The options which changed but
+// require a restart to take effect are reported in the result.  Nothing is
+// applied when any of the settings to apply is invalid.
+func reloadConfig(cfg *config) (*reloadResult, error) {
+	reloadMtx.Lock()
+	defer reloadMtx.Unlock()
+
+	next, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	cur := cfg.loaded
+	result := &reloadResult{
+		RestartRequired: changedOptions(nil, reflect.ValueOf(*cur),
+			reflect.ValueOf(*next)),
+	}
+	sort.Strings(result.RestartRequired)
+
+	// Validate all of the settings to apply before applying any of them.
+	levels, err := parseDebugLevels(next.DebugLevel)
+	if err != nil {
+		return nil, err
+	}
+	if next.LogMaxSize <= 0 {
+		str := "The logmaxsize option must be greater than 0 -- " +
+			"parsed [%d]"
+		return nil, fmt.Errorf(str, next.LogMaxSize)
+	}
+	if next.LogMaxFiles < 0 {
+		str := "The logmaxfiles option may not be negative -- " +
+			"parsed [%d]"
+		return nil, fmt.Errorf(str, next.LogMaxFiles)
+	}
+	if !logformat.Valid(next.LogFormat) {
+		str := "unknown log format %q -- supported formats %v"
+		return nil, fmt.Errorf(str, next.LogFormat, logformat.Formats)
+	}
+	gateway := cfg.rpcGateway
+	var accounts []*rpcAccount
+	if gateway != nil {
+		var errs []error
+		accounts, errs = parseRPCAccounts(next.RPCAuth,
+			gateway.accounts.admin.name)
+		if len(errs) > 0 {
+			return nil, errs[0]
+		}
+	}
+	if len(next.AddPeers) > 0 && len(cfg.ConnectPeers) > 0 {
+		str := "the --addpeer and --connect options can not be mixed"
+		return nil, errors.New(str)
+	}
+
+	// Peers are added and removed through the addnode method of the RPC
+	// server.  This is done first, so nothing else is applied when it
+	// fails.  The added peers of the running configuration are those
+	// which were applied, so a later reload retries the remaining ones.
+	port := cfg.ActiveNetParams.DefaultPort
+	cur.AddPeers = normalizeAddresses(cur.AddPeers, port)
+	added, removed := diffAddresses(cur.AddPeers,
+		normalizeAddresses(next.AddPeers, port))
+	if len(added) > 0 || len(removed) > 0 {
+		if gateway == nil {
+			result.RestartRequired = append(result.RestartRequired,
+				"addpeer")
+		} else {
+			err := applyAddPeers(gateway, cur, added, removed)
+			if err != nil {
+				return nil, err
+			}
+			result.Applied = append(result.Applied, "addpeer")
+		}
+	}
+
+	// The debug levels start from the default level, as they do at
+	// startup, so subsystems which are no longer listed are reset.
+	if cur.DebugLevel != next.DebugLevel {
+		setLogLevels(defaultLogLevel)
+		setDebugLevels(levels)
+		cur.DebugLevel = next.DebugLevel
+		result.Applied = append(result.Applied, "debuglevel")
+	}
+
+	if cur.LogMaxSize != next.LogMaxSize ||
+		cur.LogMaxFiles != next.LogMaxFiles {
+
+		if logFile != nil {
+			logFile.setLimits(next.LogMaxSize, next.LogMaxFiles)
+		}
+		if cur.LogMaxSize != next.LogMaxSize {
+			result.Applied = append(result.Applied, "logmaxsize")
+		}
+		if cur.LogMaxFiles != next.LogMaxFiles {
+			result.Applied = append(result.Applied, "logmaxfiles")
+		}
+		cur.LogMaxSize = next.LogMaxSize
+		cur.LogMaxFiles = next.LogMaxFiles
+	}
+
+	if cur.LogFormat != next.LogFormat {
+		logformat.SetFormat(next.LogFormat)
+		cur.LogFormat = next.LogFormat
+		result.Applied = append(result.Applied, "logformat")
+	}
+
+	// The additional RPC accounts can only be replaced when btcd
+	// authenticates RPC requests itself.
+	if !reflect.DeepEqual(cur.RPCAuth, next.RPCAuth) {
+		if gateway != nil {
+			gateway.accounts.setAccounts(accounts)
+			cur.RPCAuth = next.RPCAuth
+			result.Applied = append(result.Applied, "rpcauth")
+		} else {
+			result.RestartRequired = append(result.RestartRequired,
+				"rpcauth")
+		}
+	}
+
+	return result, nil
+}
+
+// diffAddresses returns the addresses of next which are not in cur and those of
+// cur which are not in next.
+func diffAddresses(cur, next []string) (added, removed []string) {
+	in := func(addrs []string, addr string) bool {
+		for _, a := range addrs {
+			if a == addr {
+				return true
+			}
+		}
+		return false
+	}
+	for _, addr := range next {
+		if !in(cur, addr) {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range cur {
+		if !in(next, addr) {
+			removed = append(removed, addr)
+		}
+	}
+	return added, removed
+}
+
+// applyAddPeers removes and adds the passed peers through the addnode method
+// of the RPC server.  The added peers of the passed configuration are updated
+// as each change is applied, so they remain accurate when one of them fails.
+func applyAddPeers(gateway *rpcGateway, cur *config, added, removed []string) error {
+	for _, addr := range removed {
+		if _, err := gateway.call("addnode", addr, "remove"); err != nil {
+			return fmt.Errorf("unable to remove peer %s: %v", addr,
+				err)
+		}
+		peers := make([]string, 0, len(cur.AddPeers))
+		for _, peer := range cur.AddPeers {
+			if peer != addr {
+				peers = append(peers, peer)
+			}
+		}
+		cur.AddPeers = peers
+	}
+	for _, addr := range added {
+		if _, err := gateway.call("addnode", addr, "add"); err != nil {
+			return fmt.Errorf("unable to add peer %s: %v", addr, err)
+		}
+		cur.AddPeers = append(cur.AddPeers, addr)
+	}
+	return nil
+}
+
+// handleReloadSignals reloads the configuration each time one of the
+// reloadSignals is received until the passed quit channel is closed.
+func handleReloadSignals(cfg *config, quit <-chan struct{}) {
+	if len(reloadSignals) == 0 {
+		return
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, reloadSignals...)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-sigChan:
+			log.Infof("Received reload signal -- reloading " +
+				"configuration")
+			result, err := reloadConfig(cfg)
+			if err != nil {
+				log.Errorf("Unable to reload configuration: %v",
+					err)
+				continue
+			}
+			log.Infof("Configuration reloaded -- applied %v",
+				result.Applied)
+			if len(result.RestartRequired) > 0 {
+				log.Warnf("Changes to the following options "+
+					"require a restart: %v",
+					result.RestartRequired)
+			}
+
+		case <-quit:
+			return
+		}
+	}
+}
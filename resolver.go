@@ -0,0 +1,388 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	socks "github.com/conformal/go-socks"
+)
+
+const (
+	// resolverTimeout is the maximum time a DNS-over-HTTPS or plain DNS
+	// lookup may take before it is abandoned.
+	resolverTimeout = time.Second * 30
+
+	// dohMediaType is the media type of DNS wire format messages as
+	// defined by RFC 8484.
+	dohMediaType = "application/dns-message"
+
+	// dohMaxResponseSize is the maximum size of a DNS-over-HTTPS response
+	// body which will be accepted.
+	dohMaxResponseSize = 65535
+
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsClassINET = 1
+)
+
+var (
+	ErrDNSInvalidName      = errors.New("invalid DNS name")
+	ErrDNSInvalidResponse  = errors.New("invalid DNS response")
+	ErrDNSResponseTooLarge = errors.New("DNS response too large")
+	ErrDNSNoAddresses      = errors.New("no addresses found")
+)
+
+// lookupFunc is the signature of the DNS resolution functions used by the
+// server for peer discovery.
+type lookupFunc func(host string) ([]net.IP, error)
+
+// resolverBackend creates a lookup function for a --resolver specification.
+// The passed argument is the part of the specification following the first
+// colon, or an empty string if there is none.
+type resolverBackend func(cfg *config, arg string) (lookupFunc, error)
+
+// resolverBackends contains all of the resolver backends which may be selected
+// with the --resolver option keyed by name.
+var resolverBackends = map[string]resolverBackend{
+	"system": newSystemLookup,
+	"tor":    newTorLookup,
+	"doh":    newDoHLookup,
+	"dns":    newDNSLookup,
+}
+
+// supportedResolvers returns a sorted slice of the names of all resolver
+// backends.
+func supportedResolvers() []string {
+	names := make([]string, 0, len(resolverBackends))
+	for name := range resolverBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newLookup returns the lookup function for the passed --resolver
+// specification, which is of the form <backend>[:<argument>].
+func newLookup(cfg *config, spec string) (lookupFunc, error) {
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+
+	backend, ok := resolverBackends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown resolver %q -- supported "+
+			"resolvers %v", name, supportedResolvers())
+	}
+	return backend(cfg, arg)
+}
+
+// newSystemLookup returns a lookup function which uses the system resolver.
+func newSystemLookup(cfg *config, arg string) (lookupFunc, error) {
+	if arg != "" {
+		return nil, errors.New("the system resolver takes no argument")
+	}
+	return net.LookupIP, nil
+}
+
+// newTorLookup returns a lookup function which resolves through the Tor proxy
+// specified with --proxy.
+func newTorLookup(cfg *config, arg string) (lookupFunc, error) {
+	if arg != "" {
+		return nil, errors.New("the tor resolver takes no argument")
+	}
+	if cfg.Proxy == "" || isHTTPProxy(cfg.Proxy) {
+		return nil, errors.New("the tor resolver requires --proxy to " +
+			"be a SOCKS5 proxy")
+	}
+
+	proxy := newTorProxy(&socks.Proxy{
+		Addr:     cfg.Proxy,
+		Username: cfg.ProxyUser,
+		Password: cfg.ProxyPass,
+	}, cfg.TorIsolation)
+	return newTorResolver(proxy, cfg.ProxyTimeout).LookupIP, nil
+}
+
+// newDNSLookup returns a lookup function which queries the DNS server at the
+// passed address directly rather than the servers configured on the system.
+// Port 53 is used when the address does not specify one.  When a proxy is
+// configured, the queries are sent over TCP through it.
+func newDNSLookup(cfg *config, arg string) (lookupFunc, error) {
+	if arg == "" {
+		return nil, errors.New("the dns resolver requires a server " +
+			"address")
+	}
+
+	server := normalizeAddress(arg, "53")
+	dial := func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, server)
+	}
+
+	// Queries over UDP can't go through a proxy, so they are made over
+	// TCP with the dial function selected for normal traffic when a proxy
+	// is configured rather than leaking outside of it.  The resolver uses
+	// TCP framing for any connection which isn't a net.PacketConn.
+	if cfg.Proxy != "" {
+		proxyDial := cfg.Dial
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := proxyDial("tcp", server)
+			if err != nil {
+				return nil, err
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+			return conn, nil
+		}
+	}
+	resolver := &net.Resolver{PreferGo: true, Dial: dial}
+	return func(host string) ([]net.IP, error) {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			resolverTimeout)
+		defer cancel()
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		return ips, nil
+	}, nil
+}
+
+// newDoHLookup returns a lookup function which resolves using the
+// DNS-over-HTTPS server at the passed URL.  Connections to the server are made
+// with the dial function selected for normal traffic so the queries go through
+// the proxy when one is configured.
+func newDoHLookup(cfg *config, arg string) (lookupFunc, error) {
+	if !strings.HasPrefix(arg, "https://") &&
+		!strings.HasPrefix(arg, "http://") {
+
+		return nil, errors.New("the doh resolver requires an http or " +
+			"https URL")
+	}
+
+	dial := cfg.Dial
+	client := &http.Client{
+		Timeout: resolverTimeout,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return dial(network, addr)
+			},
+		},
+	}
+	resolver := &dohResolver{url: arg, client: client}
+	return resolver.LookupIP, nil
+}
+
+// dohResolver resolves hosts using a DNS-over-HTTPS server as specified by
+// RFC 8484.
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of the passed host.  An error
+// is only returned when neither lookup yields an address.
+func (r *dohResolver) LookupIP(host string) ([]net.IP, error) {
+	var ips []net.IP
+	var firstErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		addrs, err := r.query(host, qtype)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+
+	if len(ips) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, ErrDNSNoAddresses
+	}
+	return ips, nil
+}
+
+// query sends a single query of the passed type for host to the server and
+// returns the addresses in the answer.
+func (r *dohResolver) query(host string, qtype uint16) ([]net.IP, error) {
+	// RFC 8484 recommends an ID of 0 to make responses cache friendly.
+	msg, err := packDNSQuery(0, host, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned %s",
+			resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		dohMaxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > dohMaxResponseSize {
+		return nil, ErrDNSResponseTooLarge
+	}
+
+	return parseDNSResponse(body, 0, qtype)
+}
+
+// packDNSQuery returns a DNS wire format query message with recursion desired
+// for the passed host and query type.
+func packDNSQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return nil, ErrDNSInvalidName
+	}
+
+	msg := make([]byte, 12, 12+len(host)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, ErrDNSInvalidName
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+
+	var tail [4]byte
+	binary.BigEndian.PutUint16(tail[0:], qtype)
+	binary.BigEndian.PutUint16(tail[2:], dnsClassINET)
+	return append(msg, tail[:]...), nil
+}
+
+// skipDNSName returns the offset just past the possibly compressed domain name
+// which starts at offset off in the passed message.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, ErrDNSInvalidResponse
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				return off + 1, nil
+			}
+			off += 1 + c
+		case 0xC0:
+			// A compression pointer always ends the name.
+			return off + 2, nil
+		default:
+			return 0, ErrDNSInvalidResponse
+		}
+	}
+}
+
+// parseDNSResponse returns the addresses of the passed query type contained in
+// the answer section of the passed DNS wire format response.
+func parseDNSResponse(msg []byte, id uint16, qtype uint16) ([]net.IP, error) {
+	if len(msg) < 12 {
+		return nil, ErrDNSInvalidResponse
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, ErrDNSInvalidResponse
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, ErrDNSInvalidResponse
+	}
+	if rcode := flags & 0x000F; rcode != 0 {
+		return nil, fmt.Errorf("DNS server returned error code %d",
+			rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		var err error
+		off, err = skipDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off += 4 // type and class
+	}
+
+	var ips []net.IP
+	for i := 0; i < ancount; i++ {
+		var err error
+		off, err = skipDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, ErrDNSInvalidResponse
+		}
+		rrtype := binary.BigEndian.Uint16(msg[off:])
+		rrclass := binary.BigEndian.Uint16(msg[off+2:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, ErrDNSInvalidResponse
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+
+		// Skip records such as CNAMEs which don't carry addresses.
+		if rrtype != qtype || rrclass != dnsClassINET {
+			continue
+		}
+		switch {
+		case rrtype == dnsTypeA && rdlen == net.IPv4len,
+			rrtype == dnsTypeAAAA && rdlen == net.IPv6len:
+
+			ip := make(net.IP, rdlen)
+			copy(ip, rdata)
+			ips = append(ips, ip)
+		default:
+			return nil, ErrDNSInvalidResponse
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, ErrDNSNoAddresses
+	}
+	return ips, nil
+}
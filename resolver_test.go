@@ -0,0 +1,304 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// dnsTestRR is a resource record of a response built by dnsTestResponse.
+type dnsTestRR struct {
+	rrtype uint16
+	rdata  []byte
+}
+
+// dnsTestResponse returns a response to the passed query with the passed
+// response code and answers.  The answers refer to the name of the question
+// with a compression pointer.
+func dnsTestResponse(query []byte, rcode uint16, answers ...dnsTestRR) []byte {
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg[2:], 0x8180|rcode)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	for _, rr := range answers {
+		var hdr [12]byte
+		binary.BigEndian.PutUint16(hdr[0:], 0xC00C)
+		binary.BigEndian.PutUint16(hdr[2:], rr.rrtype)
+		binary.BigEndian.PutUint16(hdr[4:], dnsClassINET)
+		binary.BigEndian.PutUint32(hdr[6:], 300)
+		binary.BigEndian.PutUint16(hdr[10:], uint16(len(rr.rdata)))
+		msg = append(msg, hdr[:]...)
+		msg = append(msg, rr.rdata...)
+	}
+	return msg
+}
+
+// dnsTestAnswers returns the answers of the test DNS servers for the passed
+// query type.  The A answer is preceded by a CNAME which must be skipped.
+func dnsTestAnswers(qtype uint16) []dnsTestRR {
+	switch qtype {
+	case dnsTypeA:
+		return []dnsTestRR{
+			{5, []byte{4, 'h', 'o', 's', 't', 0xC0, 0x0C}},
+			{dnsTypeA, []byte{192, 0, 2, 1}},
+		}
+	case dnsTypeAAAA:
+		return []dnsTestRR{{dnsTypeAAAA, net.ParseIP("2001:db8::1")}}
+	}
+	return nil
+}
+
+// TestPackDNSQuery ensures queries are encoded in DNS wire format and invalid
+// names are rejected.
+func TestPackDNSQuery(t *testing.T) {
+	msg, err := packDNSQuery(0x1234, "seed.example.", dnsTypeAAAA)
+	if err != nil {
+		t.Fatalf("packDNSQuery: unexpected error: %v", err)
+	}
+	want := []byte{
+		0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		4, 's', 'e', 'e', 'd', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0,
+		0, dnsTypeAAAA, 0, dnsClassINET,
+	}
+	if !bytes.Equal(msg, want) {
+		t.Errorf("packDNSQuery: unexpected message - got %x, want %x",
+			msg, want)
+	}
+
+	longLabel := string(bytes.Repeat([]byte{'a'}, 64))
+	longName := string(bytes.Repeat([]byte("a."), 127)) + "a"
+	for _, name := range []string{"", ".", "a..b", longLabel, longName} {
+		_, err := packDNSQuery(0, name, dnsTypeA)
+		if err != ErrDNSInvalidName {
+			t.Errorf("packDNSQuery(%q): unexpected error - got %v, "+
+				"want %v", name, err, ErrDNSInvalidName)
+		}
+	}
+}
+
+// TestParseDNSResponse ensures addresses are extracted from responses and that
+// malformed, truncated and failed responses are rejected.
+func TestParseDNSResponse(t *testing.T) {
+	query, err := packDNSQuery(0, "seed.example", dnsTypeA)
+	if err != nil {
+		t.Fatalf("packDNSQuery: unexpected error: %v", err)
+	}
+	resp := dnsTestResponse(query, 0, dnsTestAnswers(dnsTypeA)...)
+
+	ips, err := parseDNSResponse(resp, 0, dnsTypeA)
+	if err != nil {
+		t.Fatalf("parseDNSResponse: unexpected error: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("parseDNSResponse: unexpected addresses %v", ips)
+	}
+
+	// Every truncation of the response is invalid.
+	for i := 0; i < len(resp); i++ {
+		_, err := parseDNSResponse(resp[:i], 0, dnsTypeA)
+		if err != ErrDNSInvalidResponse {
+			t.Errorf("parseDNSResponse: truncated to %d bytes: "+
+				"unexpected error - got %v, want %v", i, err,
+				ErrDNSInvalidResponse)
+		}
+	}
+
+	// A response with another ID, or which is a query, is invalid.
+	if _, err := parseDNSResponse(resp, 1, dnsTypeA); err != ErrDNSInvalidResponse {
+		t.Errorf("parseDNSResponse: mismatched ID: unexpected error - "+
+			"got %v, want %v", err, ErrDNSInvalidResponse)
+	}
+	if _, err := parseDNSResponse(query, 0, dnsTypeA); err != ErrDNSInvalidResponse {
+		t.Errorf("parseDNSResponse: query: unexpected error - got %v, "+
+			"want %v", err, ErrDNSInvalidResponse)
+	}
+
+	// An A record of the wrong length is invalid.
+	bad := dnsTestResponse(query, 0, dnsTestRR{dnsTypeA, []byte{1, 2, 3}})
+	if _, err := parseDNSResponse(bad, 0, dnsTypeA); err != ErrDNSInvalidResponse {
+		t.Errorf("parseDNSResponse: short A record: unexpected error - "+
+			"got %v, want %v", err, ErrDNSInvalidResponse)
+	}
+
+	// Errors and empty answers are reported.
+	if _, err := parseDNSResponse(dnsTestResponse(query, 3), 0, dnsTypeA); err == nil {
+		t.Errorf("parseDNSResponse: NXDOMAIN: unexpected success")
+	}
+	if _, err := parseDNSResponse(dnsTestResponse(query, 0), 0, dnsTypeA); err != ErrDNSNoAddresses {
+		t.Errorf("parseDNSResponse: no answers: unexpected error - got "+
+			"%v, want %v", err, ErrDNSNoAddresses)
+	}
+}
+
+// dohTestServer returns a DNS-over-HTTPS server which answers queries with the
+// passed function.
+func dohTestServer(t *testing.T, answer func(w http.ResponseWriter, query []byte)) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" ||
+			r.Header.Get("Content-Type") != dohMediaType {
+
+			t.Errorf("unexpected request %s %s", r.Method,
+				r.Header.Get("Content-Type"))
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		answer(w, query)
+	}))
+}
+
+// TestDoHLookup ensures A and AAAA lookups are made over DNS-over-HTTPS and
+// that failed and oversized responses are reported.
+func TestDoHLookup(t *testing.T) {
+	srv := dohTestServer(t, func(w http.ResponseWriter, query []byte) {
+		qtype := binary.BigEndian.Uint16(query[len(query)-4:])
+		w.Write(dnsTestResponse(query, 0, dnsTestAnswers(qtype)...))
+	})
+	defer srv.Close()
+
+	r := &dohResolver{url: srv.URL, client: srv.Client()}
+	ips, err := r.LookupIP("seed.example")
+	if err != nil {
+		t.Fatalf("LookupIP: unexpected error: %v", err)
+	}
+	want := []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")}
+	if len(ips) != len(want) || !ips[0].Equal(want[0]) ||
+		!ips[1].Equal(want[1]) {
+
+		t.Errorf("LookupIP: unexpected addresses - got %v, want %v",
+			ips, want)
+	}
+
+	tests := []struct {
+		name   string
+		answer func(w http.ResponseWriter, query []byte)
+		err    error
+	}{
+		{
+			name: "truncated",
+			answer: func(w http.ResponseWriter, query []byte) {
+				resp := dnsTestResponse(query, 0,
+					dnsTestAnswers(dnsTypeA)...)
+				w.Write(resp[:len(resp)-2])
+			},
+			err: ErrDNSInvalidResponse,
+		},
+		{
+			name: "oversized",
+			answer: func(w http.ResponseWriter, query []byte) {
+				resp := dnsTestResponse(query, 0,
+					dnsTestAnswers(dnsTypeA)...)
+				w.Write(resp)
+				w.Write(make([]byte, dohMaxResponseSize))
+			},
+			err: ErrDNSResponseTooLarge,
+		},
+		{
+			name: "server error",
+			answer: func(w http.ResponseWriter, query []byte) {
+				http.Error(w, "unavailable",
+					http.StatusServiceUnavailable)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		srv := dohTestServer(t, test.answer)
+		r := &dohResolver{url: srv.URL, client: srv.Client()}
+		_, err := r.LookupIP("seed.example")
+		srv.Close()
+		if err == nil || (test.err != nil && err != test.err) {
+			t.Errorf("%s: unexpected error - got %v, want %v",
+				test.name, err, test.err)
+		}
+	}
+}
+
+// TestDNSLookupProxy ensures the dns resolver sends its queries over TCP
+// through the dial function of the proxy when one is configured.
+func TestDNSLookupProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestDNSConn(conn)
+		}
+	}()
+
+	var dialed []string
+	cfg := &config{}
+	cfg.Proxy = "127.0.0.1:9050"
+	cfg.Dial = func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		return net.Dial("tcp", l.Addr().String())
+	}
+
+	lookup, err := newDNSLookup(cfg, "192.0.2.53")
+	if err != nil {
+		t.Fatalf("newDNSLookup: unexpected error: %v", err)
+	}
+	ips, err := lookup("seed.example")
+	if err != nil {
+		t.Fatalf("lookup: unexpected error: %v", err)
+	}
+	if len(ips) != 2 {
+		t.Errorf("lookup: unexpected addresses %v", ips)
+	}
+	for _, d := range dialed {
+		if d != "tcp 192.0.2.53:53" {
+			t.Errorf("lookup: unexpected dial %q", d)
+		}
+	}
+	if len(dialed) == 0 {
+		t.Errorf("lookup: the proxy was not used")
+	}
+}
+
+// serveTestDNSConn answers the length prefixed DNS queries received on the
+// passed TCP connection.
+func serveTestDNSConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var n uint16
+		if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+			return
+		}
+		query := make([]byte, n)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		// Drop any additional records, such as EDNS, from the
+		// question echoed in the response.
+		end, err := skipDNSName(query, 12)
+		if err != nil || end+4 > len(query) {
+			return
+		}
+		question := query[:end+4]
+		binary.BigEndian.PutUint16(question[10:], 0)
+		qtype := binary.BigEndian.Uint16(question[end:])
+		resp := dnsTestResponse(question, 0, dnsTestAnswers(qtype)...)
+		binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+		conn.Write(resp)
+	}
+}
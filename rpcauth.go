@@ -0,0 +1,307 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// rpcRoleAdmin is the role which may call every RPC method.
+	rpcRoleAdmin = "admin"
+
+	// rpcRoleReadOnly is the role which may only call methods which query
+	// the state of the node.
+	rpcRoleReadOnly = "readonly"
+
+	// rpcRoleMining is the role which may call the read-only methods along
+	// with those used by mining software.
+	rpcRoleMining = "mining"
+)
+
+// rpcReadOnlyMethods contains the RPC methods which only query the state of the
+// node and may be called by the readonly role.
+var rpcReadOnlyMethods = []string{
+	"decoderawtransaction",
+	"decodescript",
+	"getbestblockhash",
+	"getblock",
+	"getblockcount",
+	"getblockhash",
+	"getconnectioncount",
+	"getcurrentnet",
+	"getdifficulty",
+	"gethashespersec",
+	"getinfo",
+	"getmininginfo",
+	"getnettotals",
+	"getnetworkhashps",
+	"getpeerinfo",
+	"getrawmempool",
+	"getrawtransaction",
+	"gettxout",
+	"help",
+	"name_filter",
+	"name_history",
+	"name_scan",
+	"name_show",
+	"notifyblocks",
+	"notifynewtransactions",
+	"ping",
+	"searchrawtransactions",
+	"stopnotifyblocks",
+	"stopnotifynewtransactions",
+	"validateaddress",
+	"verifymessage",
+}
+
+// rpcMiningMethods contains the RPC methods used by mining software which the
+// mining role may call in addition to the read-only ones.
+var rpcMiningMethods = []string{
+	"getblocktemplate",
+	"getwork",
+	"submitblock",
+}
+
+// rpcOtherMethods contains the RPC methods which are neither read-only nor
+// used by mining software.  Along with those, they are the methods which may be
+// granted to an account by name.
+var rpcOtherMethods = []string{
+	"addnode",
+	"authenticate",
+	"createrawtransaction",
+	"debuglevel",
+	"getaddednodeinfo",
+	"getbestblock",
+	"getgenerate",
+	"notifyreceived",
+	"notifyspent",
+	"reloadconfig",
+	"rescan",
+	"sendrawtransaction",
+	"setgenerate",
+	"stop",
+	"stopnotifyreceived",
+	"stopnotifyspent",
+	"verifychain",
+}
+
+// rpcMethods contains every RPC method which may be granted to an account.
+var rpcMethods = func() map[string]struct{} {
+	methods := make(map[string]struct{})
+	for _, list := range [][]string{rpcReadOnlyMethods, rpcMiningMethods,
+		rpcOtherMethods} {
+
+		for _, method := range list {
+			methods[method] = struct{}{}
+		}
+	}
+	return methods
+}()
+
+// rpcAccount is an RPC user along with the methods it may call.
+type rpcAccount struct {
+	name string
+
+	// salt is the salt of the password hash, or nil when the password
+	// is stored in plain text.
+	salt []byte
+	pass []byte
+
+	// methods contains the methods the account may call.  It is nil for
+	// accounts which may call every method.
+	methods map[string]struct{}
+}
+
+// parseRPCAccount parses an account of the rpcauth option in the form
+// <user>:<password>:<permissions>.  The password is either in plain text or a
+// salted hash in the form <salt>$<hash>, where the hash is the hex encoded
+// HMAC-SHA256 of the password keyed with the salt, as used by Bitcoin Core.
+// The permissions are a + separated list of roles and the names of methods in
+// rpcMethods.  Errors do not include the account since it may contain a
+// password.
+func parseRPCAccount(s string) (*rpcAccount, error) {
+	first := strings.Index(s, ":")
+	last := strings.LastIndex(s, ":")
+	if first <= 0 || first == last {
+		return nil, errors.New("accounts must be in the form " +
+			"<user>:<password>:<permissions>")
+	}
+	name, pass, perms := s[:first], s[first+1:last], s[last+1:]
+	if pass == "" {
+		return nil, fmt.Errorf("account %s has no password", name)
+	}
+
+	account := &rpcAccount{name: name, pass: []byte(pass)}
+	if i := strings.Index(pass, "$"); i > 0 {
+		hash, err := hex.DecodeString(pass[i+1:])
+		if err == nil && len(hash) == sha256.Size {
+			account.salt = []byte(pass[:i])
+			account.pass = hash
+		}
+	}
+
+	for _, perm := range strings.Split(perms, "+") {
+		switch perm {
+		case rpcRoleAdmin:
+			account.methods = nil
+			return account, nil
+		case rpcRoleReadOnly:
+			account.allow(rpcReadOnlyMethods...)
+		case rpcRoleMining:
+			account.allow(rpcReadOnlyMethods...)
+			account.allow(rpcMiningMethods...)
+		case "":
+			return nil, fmt.Errorf("account %s has empty permissions",
+				name)
+		default:
+			if _, ok := rpcMethods[perm]; !ok {
+				str := "account %s is granted the unknown " +
+					"method %s"
+				return nil, fmt.Errorf(str, name, perm)
+			}
+			account.allow(perm)
+		}
+	}
+	return account, nil
+}
+
+// parseRPCAccounts parses the passed rpcauth options.  Account names must be
+// unique and differ from the passed name of the administrator account.  The
+// valid accounts are returned along with an error for each invalid option.
+func parseRPCAccounts(specs []string, adminUser string) ([]*rpcAccount, []error) {
+	seen := map[string]struct{}{adminUser: {}}
+	var accounts []*rpcAccount
+	var errs []error
+	for _, s := range specs {
+		account, err := parseRPCAccount(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid rpcauth option: %v",
+				err))
+			continue
+		}
+		if _, ok := seen[account.name]; ok {
+			str := "the RPC account %s is specified more than once"
+			errs = append(errs, fmt.Errorf(str, account.name))
+			continue
+		}
+		seen[account.name] = struct{}{}
+		accounts = append(accounts, account)
+	}
+	return accounts, errs
+}
+
+// allow adds the passed methods to those the account may call.
+func (a *rpcAccount) allow(methods ...string) {
+	if a.methods == nil {
+		a.methods = make(map[string]struct{})
+	}
+	for _, method := range methods {
+		a.methods[method] = struct{}{}
+	}
+}
+
+// checkPassword returns whether the passed password is that of the account.
+// The comparison takes constant time.
+func (a *rpcAccount) checkPassword(pass string) bool {
+	if a.salt == nil {
+		// Compare hashes so the time taken does not depend on the
+		// length of the password either.
+		want := sha256.Sum256(a.pass)
+		got := sha256.Sum256([]byte(pass))
+		return subtle.ConstantTimeCompare(want[:], got[:]) == 1
+	}
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(pass))
+	return hmac.Equal(mac.Sum(nil), a.pass)
+}
+
+// rpcAccounts authenticates RPC requests and authorizes their methods against
+// the RPC accounts.  The account of rpcuser and rpcpass, or of the cookie, is
+// an administrator.  The additional accounts can be replaced while running.
+type rpcAccounts struct {
+	mtx      sync.RWMutex
+	admin    *rpcAccount
+	accounts map[string]*rpcAccount
+}
+
+// newRPCAccounts returns the RPC accounts of the passed configuration.
+func newRPCAccounts(cfg *config) *rpcAccounts {
+	a := &rpcAccounts{
+		admin: &rpcAccount{
+			name: cfg.RPCConfig.User,
+			pass: []byte(cfg.RPCConfig.Pass),
+		},
+	}
+	a.setAccounts(cfg.rpcAccounts)
+	return a
+}
+
+// setAccounts replaces the additional accounts.
+func (a *rpcAccounts) setAccounts(accounts []*rpcAccount) {
+	m := make(map[string]*rpcAccount, len(accounts))
+	for _, account := range accounts {
+		m[account.name] = account
+	}
+	a.mtx.Lock()
+	a.accounts = m
+	a.mtx.Unlock()
+}
+
+// account returns the account with the passed name, or nil if there is none.
+func (a *rpcAccounts) account(user string) *rpcAccount {
+	if user == a.admin.name {
+		return a.admin
+	}
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	return a.accounts[user]
+}
+
+// authenticate returns whether the passed credentials are those of an account.
+func (a *rpcAccounts) authenticate(user, pass string) bool {
+	account := a.account(user)
+	return account != nil && account.checkPassword(pass)
+}
+
+// authorize returns whether the passed authenticated user may call the passed
+// method.
+func (a *rpcAccounts) authorize(user, method string) bool {
+	account := a.account(user)
+	if account == nil {
+		return false
+	}
+	if account.methods == nil {
+		return true
+	}
+	_, ok := account.methods[method]
+	return ok
+}
+
+// authorizeAll returns whether the passed authenticated user may call every
+// method.
+func (a *rpcAccounts) authorizeAll(user string) bool {
+	account := a.account(user)
+	return account != nil && account.methods == nil
+}
+
+// identify returns the RPC user identified by the passed verified client
+// certificate.  The common name of the certificate subject is the name of the
+// account, which may be that of rpcuser or of an rpcauth account.
+func (a *rpcAccounts) identify(cert *x509.Certificate) (string, bool) {
+	user := cert.Subject.CommonName
+	if user == "" || a.account(user) == nil {
+		return "", false
+	}
+	return user, true
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseRPCAccount ensures accounts are parsed with the methods of their
+// roles, and that unknown methods and malformed accounts are rejected.
+func TestParseRPCAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		allowed []string
+		denied  []string
+		err     string
+	}{
+		{
+			name:    "admin",
+			spec:    "ops:secret:admin",
+			allowed: []string{"stop", "getinfo", "reloadconfig"},
+		},
+		{
+			name:    "readonly",
+			spec:    "monitor:secret:readonly",
+			allowed: []string{"getinfo", "name_show"},
+			denied:  []string{"stop", "getwork", "debuglevel"},
+		},
+		{
+			name:    "mining",
+			spec:    "pool:secret:mining",
+			allowed: []string{"getinfo", "getwork", "submitblock"},
+			denied:  []string{"stop", "setgenerate"},
+		},
+		{
+			name:    "role and methods",
+			spec:    "ops:secret:readonly+addnode+debuglevel",
+			allowed: []string{"getinfo", "addnode", "debuglevel"},
+			denied:  []string{"stop", "reloadconfig"},
+		},
+		{
+			name: "unknown method",
+			spec: "monitor:secret:getblockcout",
+			err:  "unknown method getblockcout",
+		},
+		{
+			name: "unknown method after role",
+			spec: "monitor:secret:readonly+Stop",
+			err:  "unknown method Stop",
+		},
+		{
+			name: "empty permission",
+			spec: "monitor:secret:readonly+",
+			err:  "empty permissions",
+		},
+		{
+			name: "no password",
+			spec: "monitor::readonly",
+			err:  "no password",
+		},
+		{
+			name: "no permissions",
+			spec: "monitor:secret",
+			err:  "must be in the form",
+		},
+	}
+
+	for _, test := range tests {
+		account, err := parseRPCAccount(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: unexpected error - got %v, want %q",
+					test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		a := &rpcAccounts{admin: &rpcAccount{name: "admin"}}
+		a.setAccounts([]*rpcAccount{account})
+		for _, method := range test.allowed {
+			if !a.authorize(account.name, method) {
+				t.Errorf("%s: %s denied", test.name, method)
+			}
+		}
+		for _, method := range test.denied {
+			if a.authorize(account.name, method) {
+				t.Errorf("%s: %s allowed", test.name, method)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hlandauf/btcutil"
+)
+
+// rpcCertValidity is how long automatically generated RPC certificates are
+// valid for.
+const rpcCertValidity = 10 * 365 * 24 * time.Hour
+
+// rpcCertHosts returns the hosts and addresses a generated RPC certificate is
+// valid for.  These are the hosts of the RPC listeners along with the
+// addresses of all network interfaces, since listeners on unspecified
+// addresses accept connections on any of them.
+func rpcCertHosts(listeners []string) []string {
+	var hosts []string
+	seen := make(map[string]struct{})
+	addHost := func(host string) {
+		if _, ok := seen[host]; !ok {
+			hosts = append(hosts, host)
+			seen[host] = struct{}{}
+		}
+	}
+
+	for _, listener := range listeners {
+		host, _, err := net.SplitHostPort(listener)
+		if err != nil || host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			continue
+		}
+		addHost(host)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warnf("Unable to list interface addresses: %v", err)
+		return hosts
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			addHost(ipNet.IP.String())
+		}
+	}
+	return hosts
+}
+
+// genCertPair generates a self-signed certificate pair valid for the passed
+// hosts and writes it to the passed files.  The key is only readable by the
+// current user.
+func genCertPair(certFile, keyFile string, hosts []string) error {
+	log.Infof("Generating TLS certificates...")
+
+	org := "btcd autogenerated cert"
+	validUntil := time.Now().Add(rpcCertValidity)
+	cert, key, err := btcutil.NewTLSCertPair(org, validUntil, hosts)
+	if err != nil {
+		return err
+	}
+
+	// Write cert and key files.
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+	if err = ioutil.WriteFile(certFile, cert, 0666); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		os.Remove(certFile)
+		return err
+	}
+
+	log.Infof("Done generating TLS certificates")
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// rpcCookieFilename is the name of the file in the data directory the
+	// RPC authentication cookie is written to.
+	rpcCookieFilename = ".cookie"
+
+	// rpcCookieUser is the RPC username used with cookie authentication.
+	rpcCookieUser = "__cookie__"
+)
+
+// writeRPCCookie generates random RPC credentials and writes them to the
+// passed file in the form user:password, so local clients which can read the
+// file can authenticate without a configured password.  The file is only
+// readable by the current user and replaced atomically, so clients never see
+// a partially written cookie.
+func writeRPCCookie(path string) (string, string, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", "", err
+	}
+	pass := hex.EncodeToString(buf[:])
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", "", err
+	}
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, []byte(rpcCookieUser+":"+pass), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return "", "", err
+	}
+	return rpcCookieUser, pass, nil
+}
@@ -0,0 +1,513 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+)
+
+const (
+	// rpcErrInvalidParams is the JSON-RPC error code of requests with
+	// invalid parameters.
+	rpcErrInvalidParams = -32602
+
+	// rpcErrInternal is the JSON-RPC error code of requests which failed
+	// for any other reason.
+	rpcErrInternal = -32603
+)
+
+// rpcGatewayMaxRequestSize is the maximum size of the body of an HTTP POST
+// request the RPC gateway reads to authorize the methods it calls.
+const rpcGatewayMaxRequestSize = 1 << 22
+
+// rpcBackendAttempts is the number of loopback addresses the RPC server is
+// created on before giving up when the address picked for it is taken.
+const rpcBackendAttempts = 3
+
+// errRPCBackendCert is returned when the RPC server presents a certificate
+// other than the configured one to the RPC gateway.
+var errRPCBackendCert = errors.New("the RPC server presented an unexpected " +
+	"certificate")
+
+// rpcRequest is the part of a JSON-RPC request the RPC gateway authorizes and
+// serves.
+type rpcRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// rpcError is the error of a JSON-RPC response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error satisfies the error interface.
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcResponse is a JSON-RPC response.
+type rpcResponse struct {
+	Result interface{}     `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// rpcHandler serves a method of the RPC gateway itself.  Errors of type
+// *rpcError are returned to the client as they are, any other error as an
+// internal error.
+type rpcHandler func(params []json.RawMessage) (interface{}, error)
+
+// rpcGateway authenticates RPC clients against the RPC accounts and authorizes
+// the methods they call before forwarding their requests to the RPC server.
+// The RPC server only knows the credentials of rpcuser and rpcpass, or of the
+// cookie, does not support client certificates and only serves the methods of
+// the server, so the gateway listens on the RPC listeners instead while the
+// RPC server listens on a loopback address which only the gateway connects
+// to, using the administrator credentials.  The methods which control btcd
+// itself, such as reloadconfig, are served by the gateway.
+type rpcGateway struct {
+	accounts  *rpcAccounts
+	adminAuth string
+	handlers  map[string]rpcHandler
+
+	// clientCerts is whether clients present a verified certificate which
+	// identifies their RPC account.
+	clientCerts bool
+
+	backend   string
+	client    *http.Client
+	proxy     *httputil.ReverseProxy
+	server    *http.Server
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+// newRPCGateway returns a gateway which forwards requests to the RPC server at
+// the passed address.  The RPC server must present the passed DER encoded
+// certificate.
+func newRPCGateway(accounts *rpcAccounts, backend string, backendCert []byte) *rpcGateway {
+	admin := accounts.admin
+	g := &rpcGateway{
+		accounts: accounts,
+		adminAuth: "Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(admin.name+":"+string(admin.pass))),
+		handlers: make(map[string]rpcHandler),
+		backend:  backend,
+	}
+
+	// The certificate of the RPC server is pinned rather than verified
+	// against its hosts, since it need not be valid for the loopback
+	// address.
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+				if len(certs) == 0 || !bytes.Equal(certs[0], backendCert) {
+					return errRPCBackendCert
+				}
+				return nil
+			},
+		},
+	}
+	g.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = g.backend
+		},
+		Transport: transport,
+	}
+	g.client = &http.Client{Transport: transport}
+	g.server = &http.Server{Handler: g}
+	return g
+}
+
+// setupRPCGateway creates the RPC gateway for the passed configuration and
+// opens its listeners on the RPC listeners.  The RPC listeners of the
+// configuration are replaced by the loopback address the RPC server is to
+// listen on, so the gateway must be set up before the server is created, which
+// is done through createBackend.
+func setupRPCGateway(cfg *config) (*rpcGateway, error) {
+	keyPair, err := tls.LoadX509KeyPair(cfg.RPCConfig.Cert, cfg.RPCConfig.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := pickRPCBackend()
+	if err != nil {
+		return nil, err
+	}
+	g := newRPCGateway(newRPCAccounts(cfg), backend, keyPair.Certificate[0])
+	g.clientCerts = cfg.rpcClientCAs != nil
+	tlsConfig := rpcGatewayTLSConfig(keyPair, cfg.rpcClientCAs)
+	for _, addr := range cfg.RPCConfig.Listeners {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			g.stop()
+			return nil, err
+		}
+		g.listeners = append(g.listeners, tls.NewListener(l, tlsConfig))
+	}
+
+	g.handlers["debuglevel"] = handleDebugLevel
+	g.handlers["reloadconfig"] = func([]json.RawMessage) (interface{}, error) {
+		return reloadConfig(cfg)
+	}
+
+	cfg.RPCConfig.Listeners = []string{backend}
+	cfg.rpcGateway = g
+	return g, nil
+}
+
+// pickRPCBackend returns a free loopback address for the RPC server to listen
+// on.
+func pickRPCBackend() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// addrInUse returns whether another listener holds the passed address.
+func addrInUse(addr string) bool {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return true
+	}
+	l.Close()
+	return false
+}
+
+// createBackend calls the passed function, which creates the RPC server so it
+// listens on the RPC listeners of the passed configuration, as set up by
+// setupRPCGateway.  The address picked for the RPC server is only free until
+// the RPC server listens on it, so when the function fails while another
+// listener holds the address, a new address is picked and it is called again,
+// up to rpcBackendAttempts times.  A process which takes the address never
+// receives the administrator credentials, since the gateway only sends them
+// to a server which presents the certificate of the RPC server.
+func (g *rpcGateway) createBackend(cfg *config, create func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := create()
+		if err == nil || attempt == rpcBackendAttempts ||
+			!addrInUse(g.backend) {
+
+			return err
+		}
+
+		log.Warnf("RPC server address %s was taken -- retrying on "+
+			"another port", g.backend)
+		backend, err := pickRPCBackend()
+		if err != nil {
+			return err
+		}
+		g.backend = backend
+		cfg.RPCConfig.Listeners = []string{backend}
+	}
+}
+
+// rpcGatewayTLSConfig returns the TLS configuration of the RPC listeners.  When
+// certificate authorities are passed, clients must present a certificate
+// signed by one of them.
+func rpcGatewayTLSConfig(keyPair tls.Certificate, clientCAs *x509.CertPool) *tls.Config {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = clientCAs
+	}
+	return tlsConfig
+}
+
+// start starts serving RPC clients on the listeners of the gateway.
+func (g *rpcGateway) start() {
+	for _, l := range g.listeners {
+		log.Infof("RPC server listening on %s", l.Addr())
+		g.wg.Add(1)
+		go func(l net.Listener) {
+			g.server.Serve(l)
+			g.wg.Done()
+		}(l)
+	}
+}
+
+// stop closes the listeners and the connections of the gateway and waits until
+// it has stopped serving.  It may be called more than once.
+func (g *rpcGateway) stop() {
+	g.server.Close()
+	for _, l := range g.listeners {
+		l.Close()
+	}
+	g.wg.Wait()
+}
+
+// ServeHTTP authenticates and authorizes the passed request and either serves
+// it when it calls a method of the gateway or forwards it to the RPC server
+// with the administrator credentials.  Websocket clients may call any method
+// of the RPC server once connected, so only accounts which may call every
+// method may open websocket connections.
+func (g *rpcGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	websocket := r.URL.Path == "/ws"
+
+	// Websocket clients may authenticate with the authenticate command
+	// rather than HTTP basic authentication.  The RPC server only accepts
+	// the credentials of rpcuser for it, so such connections are forwarded
+	// without credentials unless a client certificate identifies them.
+	if websocket && !g.clientCerts && r.Header.Get("Authorization") == "" {
+		g.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	user, ok := g.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="btcd RPC"`)
+		http.Error(w, "401 Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	if websocket {
+		if !g.accounts.authorizeAll(user) {
+			log.Warnf("RPC user %s may not open websocket connections",
+				user)
+			http.Error(w, "403 Forbidden.", http.StatusForbidden)
+			return
+		}
+		r.Header.Set("Authorization", g.adminAuth)
+		g.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body,
+		rpcGatewayMaxRequestSize+1))
+	if err != nil {
+		http.Error(w, "400 Bad Request.", http.StatusBadRequest)
+		return
+	}
+	if len(body) > rpcGatewayMaxRequestSize {
+		http.Error(w, "413 Request Entity Too Large.",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	reqs, err := parseRPCRequests(body)
+	if err != nil {
+		http.Error(w, "400 Bad Request.", http.StatusBadRequest)
+		return
+	}
+	for _, req := range reqs {
+		if !g.accounts.authorize(user, req.Method) {
+			log.Warnf("RPC user %s may not call %s", user,
+				req.Method)
+			http.Error(w, "403 Forbidden.", http.StatusForbidden)
+			return
+		}
+	}
+
+	// The methods of the gateway are not known to the RPC server, so
+	// batches which call them can't be forwarded either.
+	for _, req := range reqs {
+		if handler, ok := g.handlers[req.Method]; ok {
+			if len(reqs) > 1 {
+				http.Error(w, "400 Bad Request -- "+req.Method+
+					" can not be batched.",
+					http.StatusBadRequest)
+				return
+			}
+			g.serve(w, req, handler)
+			return
+		}
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Authorization", g.adminAuth)
+	g.proxy.ServeHTTP(w, r)
+}
+
+// serve answers the passed request with the result of the passed handler.
+func (g *rpcGateway) serve(w http.ResponseWriter, req *rpcRequest, handler rpcHandler) {
+	resp := rpcResponse{ID: req.ID}
+	result, err := handler(req.Params)
+	if err != nil {
+		jsonErr, ok := err.(*rpcError)
+		if !ok {
+			jsonErr = &rpcError{Code: rpcErrInternal, Message: err.Error()}
+		}
+		resp.Error = jsonErr
+	} else {
+		resp.Result = result
+	}
+	if resp.ID == nil {
+		resp.ID = json.RawMessage("null")
+	}
+
+	reply, err := json.Marshal(&resp)
+	if err != nil {
+		log.Errorf("Unable to marshal reply to %s: %v", req.Method, err)
+		http.Error(w, "500 Internal Server Error.",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(reply)
+}
+
+// call calls the passed method of the RPC server with the administrator
+// credentials and returns its result.
+func (g *rpcGateway) call(method string, params ...interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "1.0",
+		"id":      "btcd",
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest("POST", "https://"+g.backend+"/",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", g.adminAuth)
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, fmt.Errorf("%s: invalid reply from the RPC server "+
+			"(%s): %v", method, resp.Status, err)
+	}
+	if reply.Error != nil {
+		return nil, fmt.Errorf("%s: %s", method, reply.Error.Message)
+	}
+	return reply.Result, nil
+}
+
+// authenticate returns the RPC user which sent the passed request.  When client
+// certificates are required, the verified certificate of the connection
+// identifies the user, and credentials need not be given but must be those of
+// the same user when they are.
+func (g *rpcGateway) authenticate(r *http.Request) (string, bool) {
+	if !g.clientCerts {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !g.accounts.authenticate(user, pass) {
+			return "", false
+		}
+		return user, true
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	user, ok := g.accounts.identify(r.TLS.VerifiedChains[0][0])
+	if !ok {
+		return "", false
+	}
+	if r.Header.Get("Authorization") != "" {
+		u, pass, ok := r.BasicAuth()
+		if !ok || u != user || !g.accounts.authenticate(u, pass) {
+			return "", false
+		}
+	}
+	return user, true
+}
+
+// parseRPCRequests parses the passed JSON-RPC request, which is either a single
+// request or a batch of them.
+func parseRPCRequests(body []byte) ([]*rpcRequest, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var elems []json.RawMessage
+		if err := json.Unmarshal(body, &elems); err != nil {
+			return nil, err
+		}
+		if len(elems) == 0 {
+			return nil, errors.New("empty batch request")
+		}
+		reqs := make([]*rpcRequest, 0, len(elems))
+		for _, elem := range elems {
+			req, err := parseRPCRequest(elem)
+			if err != nil {
+				return nil, err
+			}
+			reqs = append(reqs, req)
+		}
+		return reqs, nil
+	}
+
+	req, err := parseRPCRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	return []*rpcRequest{req}, nil
+}
+
+// parseRPCRequest parses the passed JSON-RPC request object.  encoding/json
+// matches keys case-insensitively and keeps the last of duplicate keys, which
+// the RPC server need not do, so a request could call another method than the
+// one authorized.  Requests with more than one key which matches method
+// case-insensitively, or with such a key in another case, are rejected.
+func parseRPCRequest(obj []byte) (*rpcRequest, error) {
+	dec := json.NewDecoder(bytes.NewReader(obj))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, errors.New("request is not an object")
+	}
+	var methodKey bool
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key, _ := tok.(string); strings.EqualFold(key, "method") {
+			if key != "method" || methodKey {
+				return nil, errors.New("ambiguous method")
+			}
+			methodKey = true
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+	}
+
+	var req rpcRequest
+	if err := json.Unmarshal(obj, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
@@ -0,0 +1,690 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRPCAccounts returns the RPC accounts used by the RPC gateway tests.  The
+// administrator is admin, monitor may call the read-only methods and ops may
+// call every method.
+func testRPCAccounts(t *testing.T) *rpcAccounts {
+	accounts, errs := parseRPCAccounts([]string{
+		"monitor:secret:readonly",
+		"ops:secret:admin",
+	}, "admin")
+	if len(errs) > 0 {
+		t.Fatalf("unable to parse accounts: %v", errs)
+	}
+	a := &rpcAccounts{
+		admin: &rpcAccount{name: "admin", pass: []byte("adminpass")},
+	}
+	a.setAccounts(accounts)
+	return a
+}
+
+// echoRPCServer starts a TLS server which answers each request with the
+// credentials, path and body it was sent.
+func echoRPCServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, pass, _ := r.BasicAuth()
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s:%s %s %s", user, pass, r.URL.Path, body)
+		}))
+}
+
+// TestRPCGateway ensures requests are authenticated against the RPC accounts,
+// that their methods are authorized and that they are forwarded with the
+// administrator credentials.
+func TestRPCGateway(t *testing.T) {
+	backend := echoRPCServer()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	g := newRPCGateway(testRPCAccounts(t), backendURL.Host,
+		backend.Certificate().Raw)
+
+	tests := []struct {
+		name     string
+		path     string
+		user     string
+		pass     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "administrator",
+			path:     "/",
+			user:     "admin",
+			pass:     "adminpass",
+			body:     `{"method":"stop"}`,
+			wantCode: http.StatusOK,
+			wantBody: `admin:adminpass / {"method":"stop"}`,
+		},
+		{
+			name:     "allowed method",
+			path:     "/",
+			user:     "monitor",
+			pass:     "secret",
+			body:     `{"jsonrpc":"1.0","id":1,"method":"getinfo"}`,
+			wantCode: http.StatusOK,
+			wantBody: `admin:adminpass / {"jsonrpc":"1.0","id":1,` +
+				`"method":"getinfo"}`,
+		},
+		{
+			name:     "denied method",
+			path:     "/",
+			user:     "monitor",
+			pass:     "secret",
+			body:     `{"method":"stop"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "allowed batch",
+			path:     "/",
+			user:     "monitor",
+			pass:     "secret",
+			body:     `[{"method":"getinfo"},{"method":"getblockcount"}]`,
+			wantCode: http.StatusOK,
+			wantBody: `admin:adminpass / [{"method":"getinfo"},` +
+				`{"method":"getblockcount"}]`,
+		},
+		{
+			name:     "denied batch",
+			path:     "/",
+			user:     "monitor",
+			pass:     "secret",
+			body:     `[{"method":"getinfo"},{"method":"stop"}]`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "empty batch",
+			path:     "/",
+			user:     "monitor",
+			pass:     "secret",
+			body:     `[]`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "invalid request",
+			path:     "/",
+			user:     "monitor",
+			pass:     "secret",
+			body:     `{"method":`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "wrong password",
+			path:     "/",
+			user:     "monitor",
+			pass:     "wrong",
+			body:     `{"method":"getinfo"}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown user",
+			path:     "/",
+			user:     "nobody",
+			pass:     "secret",
+			body:     `{"method":"getinfo"}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "no credentials",
+			path:     "/",
+			body:     `{"method":"getinfo"}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "websocket of unrestricted account",
+			path:     "/ws",
+			user:     "ops",
+			pass:     "secret",
+			wantCode: http.StatusOK,
+			wantBody: "admin:adminpass /ws ",
+		},
+		{
+			name:     "websocket of restricted account",
+			path:     "/ws",
+			user:     "monitor",
+			pass:     "secret",
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "websocket without credentials",
+			path:     "/ws",
+			wantCode: http.StatusOK,
+			wantBody: ": /ws ",
+		},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "https://127.0.0.1"+test.path,
+			strings.NewReader(test.body))
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		if w.Code != test.wantCode {
+			t.Errorf("%s: unexpected status - got %d, want %d",
+				test.name, w.Code, test.wantCode)
+			continue
+		}
+		if test.wantBody != "" && w.Body.String() != test.wantBody {
+			t.Errorf("%s: unexpected response - got %q, want %q",
+				test.name, w.Body.String(), test.wantBody)
+		}
+	}
+}
+
+// TestRPCGatewayBackendCert ensures requests are not forwarded to an RPC
+// server which presents a certificate other than the configured one.
+func TestRPCGatewayBackendCert(t *testing.T) {
+	backend := echoRPCServer()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	g := newRPCGateway(testRPCAccounts(t), backendURL.Host,
+		[]byte("another certificate"))
+
+	r := httptest.NewRequest("POST", "https://127.0.0.1/",
+		strings.NewReader(`{"method":"getinfo"}`))
+	r.SetBasicAuth("admin", "adminpass")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status - got %d, want %d", w.Code,
+			http.StatusBadGateway)
+	}
+}
+
+// TestRPCGatewayMethods ensures the methods of the gateway are served by it
+// rather than forwarded, and only to the accounts which may call them.
+func TestRPCGatewayMethods(t *testing.T) {
+	backend := echoRPCServer()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	g := newRPCGateway(testRPCAccounts(t), backendURL.Host,
+		backend.Certificate().Raw)
+	g.handlers["reloadconfig"] = func(params []json.RawMessage) (interface{}, error) {
+		switch len(params) {
+		case 0:
+			return &reloadResult{Applied: []string{"debuglevel"}}, nil
+		case 1:
+			return nil, &rpcError{Code: rpcErrInvalidParams,
+				Message: "invalid"}
+		}
+		return nil, errors.New("failed")
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "result",
+			user:     "admin",
+			body:     `{"id":1,"method":"reloadconfig","params":[]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"result":{"applied":["debuglevel"],` +
+				`"restartrequired":null},"error":null,"id":1}`,
+		},
+		{
+			name:     "rpc error",
+			user:     "ops",
+			body:     `{"id":"a","method":"reloadconfig","params":[1]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"result":null,"error":{"code":-32602,` +
+				`"message":"invalid"},"id":"a"}`,
+		},
+		{
+			name:     "other error",
+			user:     "admin",
+			body:     `{"method":"reloadconfig","params":[1,2]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"result":null,"error":{"code":-32603,` +
+				`"message":"failed"},"id":null}`,
+		},
+		{
+			name:     "denied method",
+			user:     "monitor",
+			body:     `{"id":1,"method":"reloadconfig"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "batch",
+			user:     "admin",
+			body:     `[{"method":"getinfo"},{"method":"reloadconfig"}]`,
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "https://127.0.0.1/",
+			strings.NewReader(test.body))
+		pass := "secret"
+		if test.user == "admin" {
+			pass = "adminpass"
+		}
+		r.SetBasicAuth(test.user, pass)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		if w.Code != test.wantCode {
+			t.Errorf("%s: unexpected status - got %d, want %d",
+				test.name, w.Code, test.wantCode)
+			continue
+		}
+		if test.wantBody != "" && w.Body.String() != test.wantBody {
+			t.Errorf("%s: unexpected response - got %q, want %q",
+				test.name, w.Body.String(), test.wantBody)
+		}
+	}
+}
+
+// TestApplyAddPeers ensures added peers are applied through the addnode method
+// of the RPC server and that the added peers of the configuration only
+// include those which were applied when the RPC server rejects one.
+func TestApplyAddPeers(t *testing.T) {
+	var calls []string
+	backend := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var req rpcRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			var addr, op string
+			json.Unmarshal(req.Params[0], &addr)
+			json.Unmarshal(req.Params[1], &op)
+			calls = append(calls, req.Method+" "+addr+" "+op)
+			if addr == "10.0.0.4:8333" {
+				io.WriteString(w, `{"result":null,"error":`+
+					`{"code":-1,"message":"rejected"},"id":"btcd"}`)
+				return
+			}
+			io.WriteString(w, `{"result":null,"error":null,"id":"btcd"}`)
+		}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	g := newRPCGateway(testRPCAccounts(t), backendURL.Host,
+		backend.Certificate().Raw)
+
+	cur := &config{}
+	cur.AddPeers = []string{"10.0.0.1:8333", "10.0.0.2:8333"}
+	added, removed := diffAddresses(cur.AddPeers, []string{
+		"10.0.0.2:8333", "10.0.0.3:8333", "10.0.0.4:8333"})
+	err := applyAddPeers(g, cur, added, removed)
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("applyAddPeers: unexpected error: %v", err)
+	}
+	wantCalls := []string{
+		"addnode 10.0.0.1:8333 remove",
+		"addnode 10.0.0.3:8333 add",
+		"addnode 10.0.0.4:8333 add",
+	}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("applyAddPeers: unexpected calls - got %v, want %v",
+			calls, wantCalls)
+	}
+	wantPeers := []string{"10.0.0.2:8333", "10.0.0.3:8333"}
+	if !reflect.DeepEqual(cur.AddPeers, wantPeers) {
+		t.Errorf("applyAddPeers: unexpected peers - got %v, want %v",
+			cur.AddPeers, wantPeers)
+	}
+}
+
+// TestParseRPCRequests ensures the methods of single and batch requests are
+// parsed and that requests whose method is ambiguous are rejected.
+func TestParseRPCRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+		err  bool
+	}{
+		{
+			name: "single",
+			body: ` {"id":1,"method":"getinfo","params":[]} `,
+			want: []string{"getinfo"},
+		},
+		{
+			name: "batch",
+			body: `[{"method":"getinfo"},{"method":"stop"}]`,
+			want: []string{"getinfo", "stop"},
+		},
+		{
+			name: "no method",
+			body: `{"id":1}`,
+			want: []string{""},
+		},
+		{
+			name: "duplicate method",
+			body: `{"method":"getinfo","method":"stop"}`,
+			err:  true,
+		},
+		{
+			name: "method in another case",
+			body: `{"method":"getinfo","Method":"stop"}`,
+			err:  true,
+		},
+		{
+			name: "only method in another case",
+			body: `{"METHOD":"stop"}`,
+			err:  true,
+		},
+		{
+			name: "duplicate method in batch",
+			body: `[{"method":"getinfo"},{"method":"getinfo","mEthod":"stop"}]`,
+			err:  true,
+		},
+		{
+			name: "escaped method key",
+			body: `{"method":"getinfo","\u006dethod":"stop"}`,
+			err:  true,
+		},
+		{
+			name: "nested method",
+			body: `{"method":"getinfo","params":[{"method":"stop"}]}`,
+			want: []string{"getinfo"},
+		},
+		{
+			name: "not an object",
+			body: `"getinfo"`,
+			err:  true,
+		},
+		{
+			name: "null in batch",
+			body: `[{"method":"getinfo"},null]`,
+			err:  true,
+		},
+		{
+			name: "empty batch",
+			body: `[]`,
+			err:  true,
+		},
+		{
+			name: "truncated",
+			body: `{"method":"getinfo"`,
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		reqs, err := parseRPCRequests([]byte(test.body))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: unexpected success", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		var methods []string
+		for _, req := range reqs {
+			methods = append(methods, req.Method)
+		}
+		if !reflect.DeepEqual(methods, test.want) {
+			t.Errorf("%s: unexpected methods - got %v, want %v",
+				test.name, methods, test.want)
+		}
+	}
+}
+
+// TestRPCGatewayCreateBackend ensures the RPC server is created on another
+// address when the one picked for it is taken, and that other errors are
+// returned as they are.
+func TestRPCGatewayCreateBackend(t *testing.T) {
+	backend, err := pickRPCBackend()
+	if err != nil {
+		t.Fatalf("pickRPCBackend: unexpected error: %v", err)
+	}
+	squatter, err := net.Listen("tcp", backend)
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer squatter.Close()
+
+	cfg := &config{}
+	cfg.RPCConfig.Listeners = []string{backend}
+	g := newRPCGateway(testRPCAccounts(t), backend, nil)
+	var server net.Listener
+	err = g.createBackend(cfg, func() error {
+		l, err := net.Listen("tcp", cfg.RPCConfig.Listeners[0])
+		if err != nil {
+			return err
+		}
+		server = l
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("createBackend: unexpected error: %v", err)
+	}
+	defer server.Close()
+	if g.backend == backend || server.Addr().String() != g.backend ||
+		!reflect.DeepEqual(cfg.RPCConfig.Listeners, []string{g.backend}) {
+
+		t.Errorf("createBackend: unexpected address %s for the server "+
+			"at %s with listeners %v", g.backend, server.Addr(),
+			cfg.RPCConfig.Listeners)
+	}
+
+	// Errors while the address is free are not retried.
+	calls := 0
+	g.backend = backend
+	squatter.Close()
+	err = g.createBackend(cfg, func() error {
+		calls++
+		return errors.New("failed")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("createBackend: unexpected error %v after %d calls",
+			err, calls)
+	}
+}
+
+// testCert creates a certificate with the passed common name, signed by the
+// passed parent, or self-signed when there is none.
+func testCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, err = x509.ParseCertificate(parent.Certificate[0])
+		if err != nil {
+			t.Fatalf("unable to parse certificate: %v", err)
+		}
+		signerKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer,
+		&key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestRPCGatewayClientCerts ensures clients must present a certificate signed
+// by one of the client certificate authorities and that its common name
+// selects the RPC account whose permissions apply.
+func TestRPCGatewayClientCerts(t *testing.T) {
+	backend := echoRPCServer()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	g := newRPCGateway(testRPCAccounts(t), backendURL.Host,
+		backend.Certificate().Raw)
+	g.clientCerts = true
+
+	ca := testCert(t, "ca", nil)
+	otherCA := testCert(t, "ca", nil)
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	server := httptest.NewUnstartedServer(g)
+	server.TLS = rpcGatewayTLSConfig(testCert(t, "server", &ca), clientCAs)
+	server.StartTLS()
+	defer server.Close()
+
+	monitorCert := testCert(t, "monitor", &ca)
+	opsCert := testCert(t, "ops", &ca)
+	strangerCert := testCert(t, "stranger", &ca)
+	foreignCert := testCert(t, "monitor", &otherCA)
+
+	tests := []struct {
+		name     string
+		cert     *tls.Certificate
+		user     string
+		pass     string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name: "no certificate",
+			path: "/",
+			body: `{"method":"getinfo"}`,
+		},
+		{
+			name: "certificate of another authority",
+			cert: &foreignCert,
+			path: "/",
+			body: `{"method":"getinfo"}`,
+		},
+		{
+			name:     "allowed method",
+			cert:     &monitorCert,
+			path:     "/",
+			body:     `{"method":"getinfo"}`,
+			wantCode: http.StatusOK,
+			wantBody: `admin:adminpass / {"method":"getinfo"}`,
+		},
+		{
+			name:     "denied method",
+			cert:     &monitorCert,
+			path:     "/",
+			body:     `{"method":"stop"}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "unknown account",
+			cert:     &strangerCert,
+			path:     "/",
+			body:     `{"method":"getinfo"}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "credentials of the account",
+			cert:     &monitorCert,
+			user:     "monitor",
+			pass:     "secret",
+			path:     "/",
+			body:     `{"method":"getinfo"}`,
+			wantCode: http.StatusOK,
+			wantBody: `admin:adminpass / {"method":"getinfo"}`,
+		},
+		{
+			name:     "credentials of another account",
+			cert:     &monitorCert,
+			user:     "ops",
+			pass:     "secret",
+			path:     "/",
+			body:     `{"method":"stop"}`,
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "websocket of unrestricted account",
+			cert:     &opsCert,
+			path:     "/ws",
+			wantCode: http.StatusOK,
+			wantBody: "admin:adminpass /ws ",
+		},
+		{
+			name:     "websocket of restricted account",
+			cert:     &monitorCert,
+			path:     "/ws",
+			wantCode: http.StatusForbidden,
+		},
+	}
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(caCert)
+	for _, test := range tests {
+		tlsConfig := &tls.Config{RootCAs: serverCAs}
+		if test.cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*test.cert}
+		}
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		r, _ := http.NewRequest("POST", server.URL+test.path,
+			strings.NewReader(test.body))
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.pass)
+		}
+		resp, err := client.Do(r)
+		if test.wantCode == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: unexpected success", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.wantCode {
+			t.Errorf("%s: unexpected status - got %d, want %d",
+				test.name, resp.StatusCode, test.wantCode)
+			continue
+		}
+		if test.wantBody != "" && string(body) != test.wantBody {
+			t.Errorf("%s: unexpected response - got %q, want %q",
+				test.name, body, test.wantBody)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shutdownProgressInterval is how often the subsystems which are still
+	// shutting down are logged.
+	shutdownProgressInterval = time.Second * 5
+
+	// shutdownAbortTimeout is the maximum time an aborted shutdown waits
+	// for the abort function to finish before giving up on it.
+	shutdownAbortTimeout = time.Second * 10
+)
+
+var (
+	// errShutdownTimeout is returned when a graceful shutdown does not
+	// complete within the shutdowntimeout option.
+	errShutdownTimeout = errors.New("graceful shutdown timed out")
+
+	// errShutdownAborted is returned when a graceful shutdown is aborted by
+	// another interrupt signal.
+	errShutdownAborted = errors.New("graceful shutdown aborted")
+)
+
+// shutdownStep is a subsystem to shut down along with the function which does
+// so.  The function must not return until the subsystem has stopped.
+type shutdownStep struct {
+	name string
+	stop func()
+}
+
+// shutdownCoordinator shuts down subsystems in order while reporting which of
+// them are still draining.  The shutdown is aborted when it takes longer than
+// the timeout, or when another interrupt signal is received while it is in
+// progress.
+type shutdownCoordinator struct {
+	timeout   time.Duration
+	setStatus func(status string)
+	steps     []shutdownStep
+
+	// pending contains the names of the subsystems which have not finished
+	// shutting down, starting with the one currently shutting down.
+	mtx     sync.Mutex
+	pending []string
+}
+
+// newShutdownCoordinator returns a shutdown coordinator which aborts the
+// shutdown after the passed timeout.  A timeout of 0 waits indefinitely.  The
+// subsystems which are still shutting down are reported through the passed
+// setStatus function, such as the SetStatus method of the service manager,
+// whenever one of them stops.  It may be nil.
+func newShutdownCoordinator(timeout time.Duration, setStatus func(status string)) *shutdownCoordinator {
+	return &shutdownCoordinator{timeout: timeout, setStatus: setStatus}
+}
+
+// add appends a subsystem to shut down once the previously added ones have
+// stopped.
+func (c *shutdownCoordinator) add(name string, stop func()) {
+	c.steps = append(c.steps, shutdownStep{name: name, stop: stop})
+	c.pending = append(c.pending, name)
+}
+
+// pendingSteps returns the names of the subsystems which are still shutting
+// down, separated by commas.
+func (c *shutdownCoordinator) pendingSteps() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return strings.Join(c.pending, ", ")
+}
+
+// reportStatus reports the subsystems which are still shutting down through
+// the status function of the coordinator, if any.
+func (c *shutdownCoordinator) reportStatus() {
+	if c.setStatus == nil {
+		return
+	}
+	pending := c.pendingSteps()
+	if pending == "" {
+		c.setStatus("Shutdown complete")
+		return
+	}
+	c.setStatus("Shutting down: waiting for " + pending)
+}
+
+// reportProgress logs the subsystems which are still shutting down.
+func (c *shutdownCoordinator) reportProgress() {
+	pending := c.pendingSteps()
+	if pending == "" {
+		return
+	}
+	log.Infof("Waiting for subsystems to shut down: %s", pending)
+}
+
+// run shuts down the added subsystems in order and waits for them to stop.
+// When the timeout expires or another interrupt signal is received first, the
+// passed abort function is called to leave persistent state consistent, and
+// errShutdownTimeout or errShutdownAborted is returned so the process can exit
+// without waiting for the remaining subsystems.
+func (c *shutdownCoordinator) run(abort func()) error {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, interruptSignals...)
+	defer signal.Stop(sigChan)
+
+	c.reportStatus()
+	done := make(chan struct{})
+	go func() {
+		for _, step := range c.steps {
+			step.stop()
+			log.Infof("Shutdown of %s complete", step.name)
+
+			c.mtx.Lock()
+			c.pending = c.pending[1:]
+			c.mtx.Unlock()
+			c.reportStatus()
+		}
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(shutdownProgressInterval)
+	defer ticker.Stop()
+
+	log.Infof("Shutting down -- send another interrupt signal to abort")
+	c.reportProgress()
+	for {
+		select {
+		case <-done:
+			return nil
+
+		case <-ticker.C:
+			c.reportProgress()
+
+		case <-timeout:
+			log.Errorf("Graceful shutdown did not complete within %v "+
+				"-- aborting while waiting for %s", c.timeout,
+				c.pendingSteps())
+			c.abort(abort)
+			return errShutdownTimeout
+
+		case sig := <-sigChan:
+			log.Warnf("Received signal (%s) during shutdown -- "+
+				"aborting while waiting for %s", sig,
+				c.pendingSteps())
+			c.abort(abort)
+			return errShutdownAborted
+		}
+	}
+}
+
+// abort calls the passed abort function, giving up on it after
+// shutdownAbortTimeout so a hung subsystem can't prevent the process from
+// exiting.
+func (c *shutdownCoordinator) abort(abort func()) {
+	done := make(chan struct{})
+	go func() {
+		abort()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownAbortTimeout):
+		log.Errorf("Abort did not complete within %v -- exiting anyway",
+			shutdownAbortTimeout)
+	}
+}
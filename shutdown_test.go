@@ -0,0 +1,68 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestShutdownCoordinator ensures subsystems are shut down in order, that the
+// pending subsystems are reported as the status each time one stops, and that
+// the abort function is only called when the shutdown times out.
+func TestShutdownCoordinator(t *testing.T) {
+	var stopped []string
+	var statuses []string
+	aborted := false
+	c := newShutdownCoordinator(time.Minute, func(status string) {
+		statuses = append(statuses, status)
+	})
+	c.add("server", func() { stopped = append(stopped, "server") })
+	c.add("database", func() { stopped = append(stopped, "database") })
+	if err := c.run(func() { aborted = true }); err != nil {
+		t.Fatalf("run: unexpected error: %v", err)
+	}
+	want := []string{"server", "database"}
+	if !reflect.DeepEqual(stopped, want) {
+		t.Errorf("run: unexpected order - got %v, want %v", stopped, want)
+	}
+	if aborted {
+		t.Errorf("run: aborted a complete shutdown")
+	}
+	if pending := c.pendingSteps(); pending != "" {
+		t.Errorf("run: unexpected pending subsystems %q", pending)
+	}
+	wantStatuses := []string{
+		"Shutting down: waiting for server, database",
+		"Shutting down: waiting for database",
+		"Shutdown complete",
+	}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("run: unexpected statuses - got %q, want %q", statuses,
+			wantStatuses)
+	}
+
+	// A subsystem which does not stop in time aborts the shutdown without
+	// waiting for the subsystems after it.
+	hang := make(chan struct{})
+	defer close(hang)
+	databaseStopped := false
+	aborted = false
+	c = newShutdownCoordinator(time.Millisecond*50, nil)
+	c.add("server", func() { <-hang })
+	c.add("database", func() { databaseStopped = true })
+	if err := c.run(func() { aborted = true }); err != errShutdownTimeout {
+		t.Errorf("run: unexpected error - got %v, want %v", err,
+			errShutdownTimeout)
+	}
+	if !aborted || databaseStopped {
+		t.Errorf("run: unexpected abort %v and database shutdown %v",
+			aborted, databaseStopped)
+	}
+	if pending := c.pendingSteps(); pending != "server, database" {
+		t.Errorf("run: unexpected pending subsystems %q", pending)
+	}
+}
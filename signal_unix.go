@@ -0,0 +1,20 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals defines the signals which cause the configuration to be
+// reloaded.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// interruptSignals defines the signals which request btcd to shut down.  When
+// one of them is received again while shutting down, the shutdown is aborted.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
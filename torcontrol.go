@@ -0,0 +1,340 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hlandauf/btcd/logformat"
+)
+
+const (
+	// torControlTimeout is the maximum time to wait for the Tor control
+	// port to answer a command.
+	torControlTimeout = time.Second * 30
+
+	// onionKeyFilename is the name of the file in the data directory in
+	// which the private key of the onion service is kept so the service
+	// retains the same address across restarts.
+	onionKeyFilename = "onion.key"
+
+	// onionV2IDLen is the length of the service ID of version 2 onion
+	// services.  They are the only onion services whose addresses can be
+	// represented by btcwire.NetAddress, which encodes them as OnionCat
+	// IPv6 addresses.
+	onionV2IDLen = 16
+)
+
+var (
+	ErrTorControlInvalidReply = errors.New("invalid tor control reply")
+	ErrTorControlNoAuthMethod = errors.New("no supported tor control " +
+		"authentication method")
+)
+
+// torController is a connection to the Tor control port as specified by the
+// Tor control protocol (control-spec.txt).
+type torController struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialTorControl connects to the Tor control port at the passed address.
+func dialTorControl(addr string) (*torController, error) {
+	conn, err := net.DialTimeout("tcp", addr, torControlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &torController{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the control connection.  Tor removes any ephemeral onion
+// services created over the connection when it is closed.
+func (c *torController) Close() error {
+	return c.conn.Close()
+}
+
+// command sends the passed command and returns the lines of the reply with
+// their status code and separator stripped.  An error is returned if the reply
+// does not have a 250 (OK) status.
+func (c *torController) command(cmd string) ([]string, error) {
+	c.conn.SetDeadline(time.Now().Add(torControlTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	_, err := c.conn.Write([]byte(cmd + "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, ErrTorControlInvalidReply
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return nil, ErrTorControlInvalidReply
+		}
+
+		switch line[3] {
+		case ' ':
+			// The final line of the reply.
+			if code != 250 {
+				return nil, fmt.Errorf("tor control command "+
+					"failed: %s", line)
+			}
+			return append(lines, line[4:]), nil
+		case '-':
+			lines = append(lines, line[4:])
+		case '+':
+			// Data replies continue until a line with a single
+			// period.
+			data := line[4:]
+			for {
+				dline, err := c.r.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				dline = strings.TrimRight(dline, "\r\n")
+				if dline == "." {
+					break
+				}
+				data += "\n" + dline
+			}
+			lines = append(lines, data)
+		default:
+			return nil, ErrTorControlInvalidReply
+		}
+	}
+}
+
+// quoteTorControl returns the passed string as a quoted string as defined by
+// the Tor control protocol.
+func quoteTorControl(str string) string {
+	str = strings.Replace(str, `\`, `\\`, -1)
+	str = strings.Replace(str, `"`, `\"`, -1)
+	return `"` + str + `"`
+}
+
+// parseControlArgs parses a line of space-separated KEY=VALUE pairs, where the
+// value may be a quoted string, into a map.  Words which are not KEY=VALUE
+// pairs are skipped.  Both the Tor control protocol and the I2P SAM protocol
+// use this format for their replies.
+func parseControlArgs(line string) map[string]string {
+	args := make(map[string]string)
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.IndexAny(line, "= ")
+		if eq < 0 || line[eq] == ' ' {
+			// Skip bare words.
+			if eq < 0 {
+				break
+			}
+			line = line[eq:]
+			continue
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			var buf []byte
+			i := 1
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				buf = append(buf, line[i])
+			}
+			value = string(buf)
+			if i < len(line) {
+				i++
+			}
+			line = line[i:]
+		} else {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		args[key] = value
+	}
+	return args
+}
+
+// authenticate authenticates the control connection.  The passed password is
+// used when it is not empty.  Otherwise, cookie authentication is used if Tor
+// offers it, falling back to no authentication.
+func (c *torController) authenticate(password string) error {
+	if password != "" {
+		_, err := c.command("AUTHENTICATE " + quoteTorControl(password))
+		return err
+	}
+
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return err
+	}
+	var methods []string
+	var cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		args := parseControlArgs(line[len("AUTH "):])
+		methods = strings.Split(args["METHODS"], ",")
+		cookieFile = args["COOKIEFILE"]
+	}
+
+	for _, method := range methods {
+		if method == "COOKIE" && cookieFile != "" {
+			cookie, err := ioutil.ReadFile(cookieFile)
+			if err != nil {
+				return err
+			}
+			_, err = c.command("AUTHENTICATE " +
+				hex.EncodeToString(cookie))
+			return err
+		}
+	}
+	for _, method := range methods {
+		if method == "NULL" {
+			_, err := c.command("AUTHENTICATE")
+			return err
+		}
+	}
+
+	return ErrTorControlNoAuthMethod
+}
+
+// addOnion creates an ephemeral onion service which forwards connections made
+// to the passed virtual port to the passed target address.  A new key is
+// generated when the passed key is empty.  The service ID and the private key
+// of the service are returned.
+func (c *torController) addOnion(key string, virtPort string, target string) (string, string, error) {
+	if key == "" {
+		key = "NEW:ED25519-V3"
+	}
+	lines, err := c.command(fmt.Sprintf("ADD_ONION %s Port=%s,%s", key,
+		virtPort, target))
+	if err != nil {
+		return "", "", err
+	}
+
+	var serviceID string
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "ServiceID="):
+			serviceID = line[len("ServiceID="):]
+		case strings.HasPrefix(line, "PrivateKey="):
+			key = line[len("PrivateKey="):]
+		}
+	}
+	if serviceID == "" {
+		return "", "", ErrTorControlInvalidReply
+	}
+
+	return serviceID, key, nil
+}
+
+// loopbackTarget returns the local address which connections forwarded from
+// an anonymity network should be made to in order to reach the passed P2P
+// listener address.
+func loopbackTarget(listener string) (string, error) {
+	host, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		} else {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// startOnionService creates an onion service for the first P2P listener using
+// the Tor control port and adds its address to the external addresses the
+// server advertises when it is a version 2 address.  The returned controller must be kept open for as long as
+// the service should remain published.
+func startOnionService(cfg *config) (*torController, error) {
+	target, err := loopbackTarget(cfg.Listeners[0])
+	if err != nil {
+		return nil, err
+	}
+	_, virtPort, err := net.SplitHostPort(cfg.Listeners[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Reuse the key of a previous run if there is one so the service keeps
+	// its address.
+	keyFile := filepath.Join(cfg.DataDir, onionKeyFilename)
+	var key string
+	if keyBytes, err := ioutil.ReadFile(keyFile); err == nil {
+		key = strings.TrimSpace(string(keyBytes))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ctl, err := dialTorControl(cfg.TorControl)
+	if err != nil {
+		return nil, err
+	}
+	err = ctl.authenticate(cfg.TorControlPass)
+	if err != nil {
+		ctl.Close()
+		return nil, err
+	}
+	serviceID, newKey, err := ctl.addOnion(key, virtPort, target)
+	if err != nil {
+		ctl.Close()
+		return nil, err
+	}
+
+	if newKey != key {
+		err = os.MkdirAll(cfg.DataDir, 0700)
+		if err == nil {
+			err = ioutil.WriteFile(keyFile, []byte(newKey+"\n"), 0600)
+		}
+		if err != nil {
+			log.Warnf("Unable to save onion service key: %v", err)
+		}
+	}
+
+	// Only advertise addresses which fit in the address messages of the
+	// P2P protocol.  Version 3 addresses are longer, so peers have to be
+	// told about them out of band.
+	addr := net.JoinHostPort(serviceID+".onion", virtPort)
+	if len(serviceID) != onionV2IDLen {
+		log.Warnf("Onion service %s forwarding to %s is not advertised "+
+			"to peers since the P2P protocol can't relay version 3 "+
+			"onion addresses", logformat.F("address", addr), target)
+		return ctl, nil
+	}
+	cfg.ExternalIPs = append(cfg.ExternalIPs, addr)
+	log.Infof("Onion service %s forwarding to %s",
+		logformat.F("address", addr), target)
+	return ctl, nil
+}
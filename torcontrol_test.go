@@ -0,0 +1,384 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// torControlExchange is a command expected by fakeTorControl along with the
+// raw reply to send for it.
+type torControlExchange struct {
+	cmd   string
+	reply string
+}
+
+// serveTorControl answers the commands of the passed script in order on the
+// passed connection to a fake Tor control port.  An error is returned if an
+// unexpected command is received.
+func serveTorControl(conn net.Conn, script []torControlExchange) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, exchange := range script {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		cmd := strings.TrimSuffix(line, "\r\n")
+		if cmd != exchange.cmd {
+			return fmt.Errorf("unexpected command %q, want %q", cmd,
+				exchange.cmd)
+		}
+		_, err = conn.Write([]byte(exchange.reply))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fakeTorControl returns a controller connected to a fake Tor control port
+// which answers the passed script.  The result of serveTorControl is sent on
+// the returned channel.
+func fakeTorControl(script []torControlExchange) (*torController, <-chan error) {
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- serveTorControl(server, script)
+	}()
+	return &torController{conn: client, r: bufio.NewReader(client)}, done
+}
+
+// TestTorControlCommand ensures single-line, multi-line and data replies are
+// parsed and that failures and malformed replies are reported.
+func TestTorControlCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  []string
+		err   bool
+	}{
+		{
+			name:  "single line",
+			reply: "250 OK\r\n",
+			want:  []string{"OK"},
+		},
+		{
+			name:  "multi-line",
+			reply: "250-ServiceID=abc\r\n250-PrivateKey=KEY\r\n250 OK\r\n",
+			want:  []string{"ServiceID=abc", "PrivateKey=KEY", "OK"},
+		},
+		{
+			name:  "data",
+			reply: "250+info=\r\nfirst\r\nsecond\r\n.\r\n250 OK\r\n",
+			want:  []string{"info=\nfirst\nsecond", "OK"},
+		},
+		{
+			name:  "failure",
+			reply: "515 Authentication failed\r\n",
+			err:   true,
+		},
+		{
+			name:  "short line",
+			reply: "25\r\n",
+			err:   true,
+		},
+		{
+			name:  "invalid code",
+			reply: "2x0 OK\r\n",
+			err:   true,
+		},
+		{
+			name:  "invalid separator",
+			reply: "250*OK\r\n",
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		ctl, done := fakeTorControl([]torControlExchange{
+			{"GETINFO version", test.reply},
+		})
+		lines, err := ctl.command("GETINFO version")
+		ctl.Close()
+		if ferr := <-done; ferr != nil {
+			t.Errorf("%s: %v", test.name, ferr)
+			continue
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: unexpected success", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(lines, test.want) {
+			t.Errorf("%s: unexpected lines - got %q, want %q",
+				test.name, lines, test.want)
+		}
+	}
+}
+
+// TestParseControlArgs ensures KEY=VALUE pairs with plain and quoted values
+// are parsed and bare words are skipped.
+func TestParseControlArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"METHODS=COOKIE,SAFECOOKIE", map[string]string{
+			"METHODS": "COOKIE,SAFECOOKIE",
+		}},
+		{`METHODS=COOKIE COOKIEFILE="/var/run/tor/control.authcookie"`,
+			map[string]string{
+				"METHODS":    "COOKIE",
+				"COOKIEFILE": "/var/run/tor/control.authcookie",
+			}},
+		{`RESULT=OK MESSAGE="a \"quoted\" \\ value" DESTINATION=abc`,
+			map[string]string{
+				"RESULT":      "OK",
+				"MESSAGE":     `a "quoted" \ value`,
+				"DESTINATION": "abc",
+			}},
+		{"HELLO REPLY  RESULT=OK bare", map[string]string{
+			"RESULT": "OK",
+		}},
+		{`KEY="unterminated`, map[string]string{"KEY": "unterminated"}},
+	}
+
+	for _, test := range tests {
+		got := parseControlArgs(test.line)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseControlArgs(%q): got %v, want %v",
+				test.line, got, test.want)
+		}
+	}
+}
+
+// TestTorControlAuthenticate ensures the password, cookie and null
+// authentication methods are used as appropriate.
+func TestTorControlAuthenticate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcontrol")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cookieFile := filepath.Join(dir, "control.authcookie")
+	err = ioutil.WriteFile(cookieFile, []byte{0xde, 0xad, 0xbe, 0xef}, 0600)
+	if err != nil {
+		t.Fatalf("unable to write cookie: %v", err)
+	}
+
+	protocolInfo := func(auth string) string {
+		return "250-PROTOCOLINFO 1\r\n250-AUTH " + auth + "\r\n" +
+			"250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n"
+	}
+	tests := []struct {
+		name     string
+		password string
+		script   []torControlExchange
+		err      error
+	}{
+		{
+			name:     "password",
+			password: `pa"ss`,
+			script: []torControlExchange{
+				{`AUTHENTICATE "pa\"ss"`, "250 OK\r\n"},
+			},
+		},
+		{
+			name: "cookie",
+			script: []torControlExchange{
+				{"PROTOCOLINFO 1", protocolInfo(
+					`METHODS=COOKIE,SAFECOOKIE COOKIEFILE="` +
+						cookieFile + `"`)},
+				{"AUTHENTICATE deadbeef", "250 OK\r\n"},
+			},
+		},
+		{
+			name: "null",
+			script: []torControlExchange{
+				{"PROTOCOLINFO 1", protocolInfo("METHODS=NULL")},
+				{"AUTHENTICATE", "250 OK\r\n"},
+			},
+		},
+		{
+			name: "unsupported",
+			script: []torControlExchange{
+				{"PROTOCOLINFO 1", protocolInfo(
+					"METHODS=HASHEDPASSWORD")},
+			},
+			err: ErrTorControlNoAuthMethod,
+		},
+	}
+
+	for _, test := range tests {
+		ctl, done := fakeTorControl(test.script)
+		err := ctl.authenticate(test.password)
+		ctl.Close()
+		if ferr := <-done; ferr != nil {
+			t.Errorf("%s: %v", test.name, ferr)
+			continue
+		}
+		if err != test.err {
+			t.Errorf("%s: unexpected error - got %v, want %v",
+				test.name, err, test.err)
+		}
+	}
+
+	// A rejected password is reported.
+	ctl, done := fakeTorControl([]torControlExchange{
+		{`AUTHENTICATE "wrong"`, "515 Authentication failed\r\n"},
+	})
+	err = ctl.authenticate("wrong")
+	ctl.Close()
+	<-done
+	if err == nil {
+		t.Errorf("rejected password: unexpected success")
+	}
+}
+
+// TestTorControlAddOnion ensures onion services are created with a new or
+// existing key and that the service ID and key are returned.
+func TestTorControlAddOnion(t *testing.T) {
+	const serviceID = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+	tests := []struct {
+		name    string
+		key     string
+		cmd     string
+		reply   string
+		wantKey string
+	}{
+		{
+			name: "new key",
+			cmd:  "ADD_ONION NEW:ED25519-V3 Port=8333,127.0.0.1:8333",
+			reply: "250-ServiceID=" + serviceID + "\r\n" +
+				"250-PrivateKey=ED25519-V3:secret\r\n250 OK\r\n",
+			wantKey: "ED25519-V3:secret",
+		},
+		{
+			name:    "existing key",
+			key:     "ED25519-V3:secret",
+			cmd:     "ADD_ONION ED25519-V3:secret Port=8333,127.0.0.1:8333",
+			reply:   "250-ServiceID=" + serviceID + "\r\n250 OK\r\n",
+			wantKey: "ED25519-V3:secret",
+		},
+	}
+
+	for _, test := range tests {
+		ctl, done := fakeTorControl([]torControlExchange{
+			{test.cmd, test.reply},
+		})
+		id, key, err := ctl.addOnion(test.key, "8333", "127.0.0.1:8333")
+		ctl.Close()
+		if ferr := <-done; ferr != nil {
+			t.Errorf("%s: %v", test.name, ferr)
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if id != serviceID || key != test.wantKey {
+			t.Errorf("%s: unexpected result - got %s %s, want %s %s",
+				test.name, id, key, serviceID, test.wantKey)
+		}
+	}
+
+	// A reply without a service ID is invalid.
+	ctl, done := fakeTorControl([]torControlExchange{
+		{"ADD_ONION NEW:ED25519-V3 Port=8333,127.0.0.1:8333", "250 OK\r\n"},
+	})
+	_, _, err := ctl.addOnion("", "8333", "127.0.0.1:8333")
+	ctl.Close()
+	<-done
+	if err != ErrTorControlInvalidReply {
+		t.Errorf("missing service ID: unexpected error - got %v, want %v",
+			err, ErrTorControlInvalidReply)
+	}
+}
+
+// TestStartOnionService ensures only onion addresses which the P2P protocol
+// can carry are added to the external addresses.
+func TestStartOnionService(t *testing.T) {
+	tests := []struct {
+		name      string
+		serviceID string
+		want      []string
+	}{
+		{
+			name:      "version 2",
+			serviceID: "expyuzz4wqqyqhjn",
+			want:      []string{"expyuzz4wqqyqhjn.onion:8333"},
+		},
+		{
+			name:      "version 3",
+			serviceID: "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd",
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "torcontrol")
+		if err != nil {
+			t.Fatalf("unable to create temp dir: %v", err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to listen: %v", err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			done <- serveTorControl(conn, []torControlExchange{
+				{`AUTHENTICATE "pass"`, "250 OK\r\n"},
+				{"ADD_ONION NEW:ED25519-V3 Port=8333,127.0.0.1:8333",
+					"250-ServiceID=" + test.serviceID + "\r\n" +
+						"250-PrivateKey=KEY\r\n250 OK\r\n"},
+			})
+		}()
+
+		cfg := &config{}
+		cfg.Listeners = []string{":8333"}
+		cfg.DataDir = dir
+		cfg.TorControl = l.Addr().String()
+		cfg.TorControlPass = "pass"
+		ctl, err := startOnionService(cfg)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else {
+			ctl.Close()
+		}
+		if ferr := <-done; ferr != nil {
+			t.Errorf("%s: %v", test.name, ferr)
+		}
+		l.Close()
+
+		if !reflect.DeepEqual(cfg.ExternalIPs, test.want) {
+			t.Errorf("%s: unexpected external addresses - got %v, "+
+				"want %v", test.name, cfg.ExternalIPs, test.want)
+		}
+		key, err := ioutil.ReadFile(filepath.Join(dir, onionKeyFilename))
+		if err != nil || string(key) != "KEY\n" {
+			t.Errorf("%s: key not saved: %q %v", test.name, key, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
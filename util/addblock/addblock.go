@@ -12,6 +12,7 @@ import (
 	//"github.com/hlandauf/btcchain"
   "github.com/hlandau/xlog"
 	"github.com/hlandauf/btcd/limits"
+	"github.com/hlandauf/btcd/logformat"
 	"github.com/hlandauf/btcdb"
 	_ "github.com/hlandauf/btcdb/ldb"
 )
@@ -37,7 +38,7 @@ func loadBlockDB() (btcdb.Db, error) {
 	}
 	dbPath := filepath.Join(cfg.DataDir, dbName)
 
-	log.Infof("Loading block database from '%s'", dbPath)
+	log.Infof("Loading block database from '%s'", logformat.F("path", dbPath))
 	db, err := btcdb.OpenDB(cfg.DbType, dbPath)
 	if err != nil {
 		// Return the error if it's not because the database doesn't
@@ -64,7 +65,8 @@ func loadBlockDB() (btcdb.Db, error) {
 		return nil, err
 	}
 
-	log.Infof("Block database loaded with block height %d", height)
+	log.Infof("Block database loaded with block height %d",
+		logformat.F("height", height))
 	return db, nil
 }
 
@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 
 	flags "github.com/conformal/go-flags"
+	"github.com/hlandauf/btcd/logformat"
+	"github.com/hlandauf/btcd/nmcnet"
 	"github.com/hlandauf/btcdb"
 	_ "github.com/hlandauf/btcdb/ldb"
 	"github.com/hlandauf/btcnet"
@@ -18,9 +20,10 @@ import (
 )
 
 const (
-	defaultDbType   = "leveldb"
-	defaultDataFile = "bootstrap.dat"
-	defaultProgress = 10
+	defaultDbType    = "leveldb"
+	defaultDataFile  = "bootstrap.dat"
+	defaultProgress  = 10
+	defaultLogFormat = logformat.Text
 )
 
 var (
@@ -40,8 +43,10 @@ type config struct {
 	TestNet3       bool   `long:"testnet" description:"Use the test network"`
 	RegressionTest bool   `long:"regtest" description:"Use the regression test network"`
 	SimNet         bool   `long:"simnet" description:"Use the simulation test network"`
+	NetParams      string `long:"netparams" description:"Use the custom network defined by the given JSON parameters file"`
 	InFile         string `short:"i" long:"infile" description:"File containing the block(s)"`
 	Progress       int    `short:"p" long:"progress" description:"Show a progress message each time this number of seconds have passed -- Use 0 to disable progress announcements"`
+	LogFormat      string `long:"logformat" description:"Format of log output {text, json}"`
 }
 
 // filesExists reports whether the named file or directory exists.
@@ -87,10 +92,11 @@ func netName(netParams *btcnet.Params) string {
 func loadConfig() (*config, []string, error) {
 	// Default config.
 	cfg := config{
-		DataDir:  defaultDataDir,
-		DbType:   defaultDbType,
-		InFile:   defaultDataFile,
-		Progress: defaultProgress,
+		DataDir:   defaultDataDir,
+		DbType:    defaultDbType,
+		InFile:    defaultDataFile,
+		Progress:  defaultProgress,
+		LogFormat: defaultLogFormat,
 	}
 
 	// Parse command line options.
@@ -110,19 +116,31 @@ func loadConfig() (*config, []string, error) {
 	// while we're at it
 	if cfg.TestNet3 {
 		numNets++
-		activeNetParams = &btcnet.TestNet3Params
+		activeNetParams = &nmcnet.TestNetParams
 	}
 	if cfg.RegressionTest {
 		numNets++
-		activeNetParams = &btcnet.RegressionNetParams
+		activeNetParams = &nmcnet.RegressionNetParams
 	}
 	if cfg.SimNet {
 		numNets++
 		activeNetParams = &btcnet.SimNetParams
 	}
+	if cfg.NetParams != "" {
+		numNets++
+		params, err := nmcnet.LoadParamsFile(cfg.NetParams)
+		if err != nil {
+			str := "%s: Unable to load network parameters from %s: %v"
+			err := fmt.Errorf(str, funcName, cfg.NetParams, err)
+			fmt.Fprintln(os.Stderr, err)
+			parser.WriteHelp(os.Stderr)
+			return nil, nil, err
+		}
+		activeNetParams = params
+	}
 	if numNets > 1 {
-		str := "%s: The testnet, regtest, and simnet params can't be " +
-			"used together -- choose one of the three"
+		str := "%s: The testnet, regtest, simnet, and netparams options " +
+			"can't be used together -- choose one of the four"
 		err := fmt.Errorf(str, funcName)
 		fmt.Fprintln(os.Stderr, err)
 		parser.WriteHelp(os.Stderr)
@@ -139,6 +157,14 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	// Validate and select the log format.
+	if err := logformat.SetFormat(cfg.LogFormat); err != nil {
+		err := fmt.Errorf("%s: %v", "loadConfig", err)
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return nil, nil, err
+	}
+
 	// Append the network type to the data directory so it is "namespaced"
 	// per network.  In addition to the block database, there are other
 	// pieces of data that are saved to disk such as address manager state.
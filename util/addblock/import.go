@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/hlandauf/btcchain"
+	"github.com/hlandauf/btcd/logformat"
 	"github.com/hlandauf/btcdb"
 	_ "github.com/hlandauf/btcdb/ldb"
 	"github.com/hlandauf/btcutil"
@@ -207,7 +208,7 @@ func (bi *blockImporter) logProgress() {
 	}
 	log.Infof("Processed %d %s in the last %s (%d %s, height %d, %s)",
 		bi.receivedLogBlocks, blockStr, tDuration, bi.receivedLogTx,
-		txStr, bi.lastHeight, bi.lastBlockTime)
+		txStr, logformat.F("height", bi.lastHeight), bi.lastBlockTime)
 
 	bi.receivedLogBlocks = 0
 	bi.receivedLogTx = 0
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"sort"
 	"strconv"
@@ -104,6 +107,7 @@ var commandHandlers = map[string]*handlerData{
 	"listunspent":           {0, 3, displayJSONDump, []conversionHandler{toInt, toInt, nil}, makeListUnspent, "[minconf=1] [maxconf=9999999] [jsonaddressarray]"},
 	"lockunspent":           {1, 2, displayJSONDump, []conversionHandler{toBool, nil}, makeLockUnspent, "<unlock> " + outpointArrayStr},
 	"ping":                  {0, 0, displayGeneric, nil, makePing, ""},
+	"reloadconfig":          {0, 0, displayJSONDump, nil, makeReloadConfig, ""},
 	"sendfrom": {3, 3, displayGeneric, []conversionHandler{nil, nil, toSatoshi, toInt, nil, nil},
 		makeSendFrom, "<account> <address> <amount> [minconf=1] [comment] [comment-to]"},
 	"sendmany":               {2, 2, displayGeneric, []conversionHandler{nil, nil, toInt, nil}, makeSendMany, "<account> <{\"address\":amount,...}> [minconf=1] [comment]"},
@@ -811,6 +815,11 @@ func makeSignRawTransaction(args []interface{}) (btcjson.Cmd, error) {
 	return btcjson.NewSignRawTransactionCmd("btcctl", args[0].(string), optArgs...)
 }
 
+// makeReloadConfig generates the cmd structure for reloadconfig commands.
+func makeReloadConfig(args []interface{}) (btcjson.Cmd, error) {
+	return btcjson.NewRawCmd("btcctl", "reloadconfig", nil)
+}
+
 // makeStop generates the cmd structure for stop commands.
 func makeStop(args []interface{}) (btcjson.Cmd, error) {
 	return btcjson.NewStopCmd("btcctl")
@@ -871,13 +880,66 @@ func makeNameShow(args []interface{}) (btcjson.Cmd, error) {
   return nctypes.NewNameShowCmd("btcctl", args[0].(string))
 }
 
+// clientCertRPCCommand sends the passed JSON-RPC message over TLS like
+// btcjson.TlsRpcCommand, but also presents the client certificate specified
+// in the configuration to the server.  The server certificate is verified
+// against the passed PEM encoded certificates, or the system roots when there
+// are none.
+func clientCertRPCCommand(cfg *config, msg []byte, pem []byte) (btcjson.Reply, error) {
+	var reply btcjson.Reply
+	cert, err := tls.LoadX509KeyPair(cfg.RPCClientCert, cfg.RPCClientKey)
+	if err != nil {
+		return reply, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: cfg.TLSSkipVerify,
+	}
+	if len(pem) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return reply, fmt.Errorf("no valid certificates in %s",
+				cfg.RPCCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	method, err := btcjson.JSONGetMethod(msg)
+	if err != nil {
+		return reply, err
+	}
+	req, err := http.NewRequest("POST", "https://"+cfg.RPCServer,
+		bytes.NewReader(msg))
+	if err != nil {
+		return reply, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.RPCUser != "" || cfg.RPCPassword != "" {
+		req.SetBasicAuth(cfg.RPCUser, cfg.RPCPassword)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return reply, err
+	}
+	body, err := btcjson.GetRaw(resp.Body)
+	if err != nil {
+		return reply, err
+	}
+	return btcjson.ReadResultCmd(method, body)
+}
+
 // send sends a JSON-RPC command to the specified RPC server and examines the
 // results for various error conditions.  It either returns a valid result or
 // an appropriate error.
 func send(cfg *config, msg []byte) (interface{}, error) {
 	var reply btcjson.Reply
 	var err error
-	if cfg.NoTLS || (cfg.RPCCert == "" && !cfg.TLSSkipVerify) {
+	if cfg.NoTLS || (cfg.RPCCert == "" && !cfg.TLSSkipVerify &&
+		cfg.RPCClientCert == "") {
+
 		reply, err = btcjson.RpcCommand(cfg.RPCUser, cfg.RPCPassword,
 			cfg.RPCServer, msg)
 	} else {
@@ -888,9 +950,13 @@ func send(cfg *config, msg []byte) (interface{}, error) {
 				return nil, err
 			}
 		}
-		reply, err = btcjson.TlsRpcCommand(cfg.RPCUser,
-			cfg.RPCPassword, cfg.RPCServer, msg, pem,
-			cfg.TLSSkipVerify)
+		if cfg.RPCClientCert != "" {
+			reply, err = clientCertRPCCommand(cfg, msg, pem)
+		} else {
+			reply, err = btcjson.TlsRpcCommand(cfg.RPCUser,
+				cfg.RPCPassword, cfg.RPCServer, msg, pem,
+				cfg.TLSSkipVerify)
+		}
 	}
 	if err != nil {
 		return nil, err
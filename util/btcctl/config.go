@@ -2,13 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
 
 	flags "github.com/conformal/go-flags"
+	"github.com/hlandauf/btcd/nmcnet"
+	"github.com/hlandauf/btcnet"
 	"github.com/hlandauf/btcutil"
+	"github.com/hlandauf/btcwire"
 )
 
 var (
@@ -19,8 +23,13 @@ var (
 	defaultRPCServer      = "localhost"
 	defaultRPCCertFile    = filepath.Join(btcdHomeDir, "rpc.cert")
 	defaultWalletCertFile = filepath.Join(btcwalletHomeDir, "rpc.cert")
+	defaultBtcdDataDir    = filepath.Join(btcdHomeDir, "data")
 )
 
+// rpcCookieFilename is the name of the file in the network specific btcd data
+// directory which btcd writes its RPC authentication cookie to.
+const rpcCookieFilename = ".cookie"
+
 // config defines the configuration options for btcctl.
 //
 // See loadConfig for details on the configuration load process.
@@ -31,37 +40,33 @@ type config struct {
 	RPCPassword   string `short:"P" long:"rpcpass" default-mask:"-" description:"RPC password"`
 	RPCServer     string `short:"s" long:"rpcserver" description:"RPC server to connect to"`
 	RPCCert       string `short:"c" long:"rpccert" description:"RPC server certificate chain for validation"`
+	RPCClientCert string `long:"rpcclientcert" description:"Client certificate to present to the RPC server"`
+	RPCClientKey  string `long:"rpcclientkey" description:"Key of the client certificate"`
 	NoTLS         bool   `long:"notls" description:"Disable TLS"`
 	TestNet3      bool   `long:"testnet" description:"Connect to testnet"`
+	RegTest       bool   `long:"regtest" description:"Connect to the regression test network"`
 	SimNet        bool   `long:"simnet" description:"Connect to the simulation test network"`
+	NetParams     string `long:"netparams" description:"Connect to the custom network defined by the given JSON parameters file"`
 	TLSSkipVerify bool   `long:"skipverify" description:"Do not verify tls certificates (not recommended!)"`
 	Wallet        bool   `long:"wallet" description:"Connect to wallet"`
 }
 
-// normalizeAddress returns addr with the passed default port appended if
-// there is not already a port specified.
-func normalizeAddress(addr string, useTestNet3, useSimNet, useWallet bool) string {
+// normalizeAddress returns addr with the default RPC port of the passed
+// network appended if there is not already a port specified.  btcd listens on
+// the RPC port of its network parameters, while the wallet ports are those of
+// btcwallet.
+func normalizeAddress(addr string, netParams *btcnet.Params, useWallet bool) string {
 	_, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		var defaultPort string
-		switch {
-		case useTestNet3:
-			if useWallet {
+		defaultPort := netParams.RPCPort
+		if useWallet {
+			switch netParams {
+			case &nmcnet.TestNetParams, &nmcnet.RegressionNetParams:
 				defaultPort = "18332"
-			} else {
-				defaultPort = "18334"
-			}
-		case useSimNet:
-			if useWallet {
+			case &btcnet.SimNetParams:
 				defaultPort = "18554"
-			} else {
-				defaultPort = "18556"
-			}
-		default:
-			if useWallet {
+			default:
 				defaultPort = "8332"
-			} else {
-				defaultPort = "8336" // XXX TODO, was: "8334"
 			}
 		}
 
@@ -70,6 +75,32 @@ func normalizeAddress(addr string, useTestNet3, useSimNet, useWallet bool) strin
 	return addr
 }
 
+// netName returns the name of the btcd data directory subdirectory for the
+// passed network.
+func netName(netParams *btcnet.Params) string {
+	switch netParams.Net {
+	case btcwire.TestNet3:
+		return "testnet"
+	default:
+		return netParams.Name
+	}
+}
+
+// readRPCCookie returns the RPC username and password stored in the passed
+// cookie file in the form user:password.
+func readRPCCookie(path string) (string, string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	cookie := strings.TrimSpace(string(b))
+	i := strings.Index(cookie, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("malformed cookie file %s", path)
+	}
+	return cookie[:i], cookie[i+1:], nil
+}
+
 // cleanAndExpandPath expands environement variables and leading ~ in the
 // passed path, cleans the result, and returns it.
 func cleanAndExpandPath(path string) string {
@@ -147,12 +178,18 @@ func loadConfig() (*flags.Parser, *config, []string, error) {
 	if cfg.TestNet3 {
 		numNets++
 	}
+	if cfg.RegTest {
+		numNets++
+	}
 	if cfg.SimNet {
 		numNets++
 	}
+	if cfg.NetParams != "" {
+		numNets++
+	}
 	if numNets > 1 {
-		str := "%s: The testnet and simnet params can't be used " +
-			"together -- choose one of the two"
+		str := "%s: The testnet, regtest, simnet, and netparams options " +
+			"can't be used together -- choose one of the four"
 		err := fmt.Errorf(str, "loadConfig")
 		fmt.Fprintln(os.Stderr, err)
 		return parser, nil, nil, err
@@ -167,10 +204,63 @@ func loadConfig() (*flags.Parser, *config, []string, error) {
 	// Handle environment variable expansion in the RPC certificate path.
 	cfg.RPCCert = cleanAndExpandPath(cfg.RPCCert)
 
-	// Add default port to RPC server based on --testnet and --wallet flags
-	// if needed.
-	cfg.RPCServer = normalizeAddress(cfg.RPCServer, cfg.TestNet3,
-		cfg.SimNet, cfg.Wallet)
+	// A client certificate needs its key, and is only used with TLS.
+	if (cfg.RPCClientCert == "") != (cfg.RPCClientKey == "") {
+		str := "%s: The rpcclientcert and rpcclientkey options must " +
+			"be specified together"
+		err := fmt.Errorf(str, "loadConfig")
+		fmt.Fprintln(os.Stderr, err)
+		return parser, nil, nil, err
+	}
+	if cfg.RPCClientCert != "" && cfg.NoTLS {
+		str := "%s: The rpcclientcert and notls options can't be used " +
+			"together"
+		err := fmt.Errorf(str, "loadConfig")
+		fmt.Fprintln(os.Stderr, err)
+		return parser, nil, nil, err
+	}
+	if cfg.RPCClientCert != "" {
+		cfg.RPCClientCert = cleanAndExpandPath(cfg.RPCClientCert)
+		cfg.RPCClientKey = cleanAndExpandPath(cfg.RPCClientKey)
+	}
+
+	// Select the network parameters, which are used for the default RPC
+	// port and the name of the btcd data directory the RPC cookie is read
+	// from.
+	netParams := &btcnet.NmcMainNetParams
+	switch {
+	case cfg.TestNet3:
+		netParams = &nmcnet.TestNetParams
+	case cfg.RegTest:
+		netParams = &nmcnet.RegressionNetParams
+	case cfg.SimNet:
+		netParams = &btcnet.SimNetParams
+	case cfg.NetParams != "":
+		params, err := nmcnet.LoadParamsFile(cleanAndExpandPath(
+			cfg.NetParams))
+		if err != nil {
+			str := "%s: Unable to load network parameters from %s: %v"
+			err := fmt.Errorf(str, "loadConfig", cfg.NetParams, err)
+			fmt.Fprintln(os.Stderr, err)
+			return parser, nil, nil, err
+		}
+		netParams = params
+	}
+
+	// Add the default port to RPC server based on the network and --wallet
+	// flags if needed.
+	cfg.RPCServer = normalizeAddress(cfg.RPCServer, netParams, cfg.Wallet)
+
+	// Authenticate with the cookie btcd writes to its data directory when
+	// no credentials are specified and the cookie can be read.
+	if !cfg.Wallet && cfg.RPCUser == "" && cfg.RPCPassword == "" {
+		cookiePath := filepath.Join(defaultBtcdDataDir,
+			netName(netParams), rpcCookieFilename)
+		user, pass, err := readRPCCookie(cookiePath)
+		if err == nil {
+			cfg.RPCUser, cfg.RPCPassword = user, pass
+		}
+	}
 
 	return parser, &cfg, remainingArgs, nil
 }
@@ -0,0 +1,202 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	flags "github.com/conformal/go-flags"
+	"github.com/hlandauf/btcd/logformat"
+	"github.com/hlandauf/btcd/nmcnet"
+	"github.com/hlandauf/btcdb"
+	_ "github.com/hlandauf/btcdb/ldb"
+	_ "github.com/hlandauf/btcdb/memdb"
+	"github.com/hlandauf/btcnet"
+	"github.com/hlandauf/btcutil"
+	"github.com/hlandauf/btcwire"
+)
+
+const (
+	defaultSrcDbType = "leveldb"
+	defaultProgress  = 10
+	defaultLogFormat = logformat.Text
+)
+
+var (
+	btcdHomeDir     = btcutil.AppDataDir("btcd-nmc", false)
+	defaultDataDir  = filepath.Join(btcdHomeDir, "data")
+	knownDbTypes    = btcdb.SupportedDBs()
+	activeNetParams = &btcnet.NmcMainNetParams
+)
+
+// config defines the configuration options for dbmigrate.
+//
+// See loadConfig for details on the configuration load process.
+type config struct {
+	DataDir        string `short:"b" long:"datadir" description:"Location of the btcd data directory"`
+	DstDataDir     string `long:"dstdatadir" description:"Location of the data directory to write the destination database to -- The default is the source data directory"`
+	SrcDbType      string `long:"srcdbtype" description:"Database backend of the existing block database"`
+	DstDbType      string `long:"dstdbtype" description:"Database backend of the new block database -- memdb verifies the source in an in-memory snapshot which is discarded on exit" required:"true"`
+	TestNet3       bool   `long:"testnet" description:"Use the test network"`
+	RegressionTest bool   `long:"regtest" description:"Use the regression test network"`
+	SimNet         bool   `long:"simnet" description:"Use the simulation test network"`
+	NetParams      string `long:"netparams" description:"Use the custom network defined by the given JSON parameters file"`
+	Progress       int    `short:"p" long:"progress" description:"Show a progress message each time this number of seconds have passed -- Use 0 to disable progress announcements"`
+	LogFormat      string `long:"logformat" description:"Format of log output {text, json}"`
+}
+
+// filesExists reports whether the named file or directory exists.
+func fileExists(name string) bool {
+	if _, err := os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// validDbType returns whether or not dbType is a supported database type.
+func validDbType(dbType string) bool {
+	for _, knownType := range knownDbTypes {
+		if dbType == knownType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkDbTypes returns an error when the passed source or destination database
+// type can't be migrated.  The memdb type keeps blocks in memory only, so it
+// can't hold an existing database, but it can be migrated to in order to take
+// a verified snapshot of the source.
+func checkDbTypes(srcDbType, dstDbType string) error {
+	for _, dbType := range []string{srcDbType, dstDbType} {
+		if !validDbType(dbType) {
+			return fmt.Errorf("The specified database type [%v] is "+
+				"invalid -- supported types %v", dbType,
+				knownDbTypes)
+		}
+	}
+	if srcDbType == "memdb" {
+		return fmt.Errorf("The memdb database type keeps blocks in " +
+			"memory only and can't be migrated from")
+	}
+	return nil
+}
+
+// netName returns the name used when referring to a bitcoin network.  At the
+// time of writing, btcd currently places blocks for testnet version 3 in the
+// data and log directory "testnet", which does not match the Name field of the
+// btcnet parameters.  This function can be used to override this directory name
+// as "testnet" when the passed active network matches btcwire.TestNet3.
+//
+// A proper upgrade to move the data and log directories for this network to
+// "testnet3" is planned for the future, at which point this function can be
+// removed and the network parameter's name used instead.
+func netName(netParams *btcnet.Params) string {
+	switch netParams.Net {
+	case btcwire.TestNet3:
+		return "testnet"
+	default:
+		return netParams.Name
+	}
+}
+
+// loadConfig initializes and parses the config using command line options.
+func loadConfig() (*config, []string, error) {
+	// Default config.
+	cfg := config{
+		DataDir:   defaultDataDir,
+		SrcDbType: defaultSrcDbType,
+		Progress:  defaultProgress,
+		LogFormat: defaultLogFormat,
+	}
+
+	// Parse command line options.
+	parser := flags.NewParser(&cfg, flags.Default)
+	remainingArgs, err := parser.Parse()
+	if err != nil {
+		if e, ok := err.(*flags.Error); !ok || e.Type != flags.ErrHelp {
+			parser.WriteHelp(os.Stderr)
+		}
+		return nil, nil, err
+	}
+
+	// Multiple networks can't be selected simultaneously.
+	funcName := "loadConfig"
+	numNets := 0
+	// Count number of network flags passed; assign active network params
+	// while we're at it
+	if cfg.TestNet3 {
+		numNets++
+		activeNetParams = &nmcnet.TestNetParams
+	}
+	if cfg.RegressionTest {
+		numNets++
+		activeNetParams = &nmcnet.RegressionNetParams
+	}
+	if cfg.SimNet {
+		numNets++
+		activeNetParams = &btcnet.SimNetParams
+	}
+	if cfg.NetParams != "" {
+		numNets++
+		params, err := nmcnet.LoadParamsFile(cfg.NetParams)
+		if err != nil {
+			str := "%s: Unable to load network parameters from %s: %v"
+			err := fmt.Errorf(str, funcName, cfg.NetParams, err)
+			fmt.Fprintln(os.Stderr, err)
+			parser.WriteHelp(os.Stderr)
+			return nil, nil, err
+		}
+		activeNetParams = params
+	}
+	if numNets > 1 {
+		str := "%s: The testnet, regtest, simnet, and netparams options " +
+			"can't be used together -- choose one of the four"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return nil, nil, err
+	}
+
+	// Validate database types.
+	if err := checkDbTypes(cfg.SrcDbType, cfg.DstDbType); err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return nil, nil, err
+	}
+
+	// Validate and select the log format.
+	if err := logformat.SetFormat(cfg.LogFormat); err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return nil, nil, err
+	}
+
+	// Append the network type to the data directories so they are
+	// "namespaced" per network in the same way btcd does.
+	if cfg.DstDataDir == "" {
+		cfg.DstDataDir = cfg.DataDir
+	}
+	cfg.DataDir = filepath.Join(cfg.DataDir, netName(activeNetParams))
+	cfg.DstDataDir = filepath.Join(cfg.DstDataDir, netName(activeNetParams))
+
+	// The source and destination must differ.
+	if cfg.DataDir == cfg.DstDataDir && cfg.SrcDbType == cfg.DstDbType {
+		str := "%s: The source and destination databases are the same"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return nil, nil, err
+	}
+
+	return &cfg, remainingArgs, nil
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// TestCheckDbTypes ensures only database types which store blocks on disk are
+// accepted as the source of a migration, while memdb is also accepted as the
+// destination.
+func TestCheckDbTypes(t *testing.T) {
+	tests := []struct {
+		src string
+		dst string
+		err bool
+	}{
+		{"leveldb", "leveldb", false},
+		{"leveldb", "memdb", false},
+		{"memdb", "leveldb", true},
+		{"leveldb", "nosuchdb", true},
+		{"nosuchdb", "leveldb", true},
+	}
+
+	for _, test := range tests {
+		err := checkDbTypes(test.src, test.dst)
+		if (err != nil) != test.err {
+			t.Errorf("checkDbTypes(%s, %s): unexpected error - got "+
+				"%v, want error %v", test.src, test.dst, err,
+				test.err)
+		}
+	}
+}
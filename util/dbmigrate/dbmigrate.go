@@ -0,0 +1,269 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/hlandau/xlog"
+	"github.com/hlandauf/btcd/limits"
+	"github.com/hlandauf/btcd/logformat"
+	"github.com/hlandauf/btcdb"
+	"github.com/hlandauf/btcwire"
+)
+
+const (
+	// blockDbNamePrefix is the prefix for the btcd block database.
+	blockDbNamePrefix = "blocks"
+)
+
+var (
+	cfg *config
+)
+
+var log, Log = xlog.New("dbmigrate")
+
+// blockDbPath returns the path of the block database of the passed type in the
+// passed data directory.
+func blockDbPath(dataDir, dbType string) string {
+	// The database name is based on the database type.
+	dbName := blockDbNamePrefix + "_" + dbType
+	if dbType == "sqlite" {
+		dbName = dbName + ".db"
+	}
+	return filepath.Join(dataDir, dbName)
+}
+
+// migrator copies the blocks of a source database to a destination database.
+type migrator struct {
+	src btcdb.Db
+	dst btcdb.Db
+
+	blocksMigrated int64
+	txMigrated     int64
+	lastLogTime    time.Time
+	lastHeight     int64
+}
+
+// migrateBlock copies the block at the passed height to the destination
+// database.  The block is verified to hash to the hash it is stored under and
+// to connect to the previous block, and once inserted, the destination must
+// return it at the same height and index all of its transactions.
+func (m *migrator) migrateBlock(height int64, prevHash *btcwire.ShaHash) (*btcwire.ShaHash, error) {
+	hash, err := m.src.FetchBlockShaByHeight(height)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch hash of block %d: %v",
+			height, err)
+	}
+	block, err := m.src.FetchBlockBySha(hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch block %v: %v", hash,
+			err)
+	}
+
+	blockHash, err := block.Sha()
+	if err != nil {
+		return nil, err
+	}
+	if !blockHash.IsEqual(hash) {
+		return nil, fmt.Errorf("block %d hashes to %v instead of %v",
+			height, blockHash, hash)
+	}
+	if prevHash != nil &&
+		!block.MsgBlock().Header.PrevBlock.IsEqual(prevHash) {
+
+		return nil, fmt.Errorf("block %v at height %d does not "+
+			"connect to the previous block %v", hash, height,
+			prevHash)
+	}
+
+	newHeight, err := m.dst.InsertBlock(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert block %v: %v", hash,
+			err)
+	}
+	if newHeight != height {
+		return nil, fmt.Errorf("block %v was inserted at height %d "+
+			"instead of %d", hash, newHeight, height)
+	}
+	dstHash, err := m.dst.FetchBlockShaByHeight(height)
+	if err != nil || !dstHash.IsEqual(hash) {
+		return nil, fmt.Errorf("block %v can't be read back at "+
+			"height %d", hash, height)
+	}
+	for _, tx := range block.Transactions() {
+		exists, err := m.dst.ExistsTxSha(tx.Sha())
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up transaction "+
+				"%v of block %v: %v", tx.Sha(), hash, err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("transaction %v of block %v is "+
+				"not indexed", tx.Sha(), hash)
+		}
+	}
+
+	m.blocksMigrated++
+	m.txMigrated += int64(len(block.Transactions()))
+	m.lastHeight = height
+	return hash, nil
+}
+
+// logProgress logs migration progress as an information message.  In order to
+// prevent spam, it limits logging to one message every cfg.Progress seconds.
+func (m *migrator) logProgress(newestHeight int64) {
+	if cfg.Progress == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(m.lastLogTime) < time.Second*time.Duration(cfg.Progress) {
+		return
+	}
+	log.Infof("Migrated %d blocks (%d transactions, height %d of %d)",
+		m.blocksMigrated, m.txMigrated,
+		logformat.F("height", m.lastHeight), newestHeight)
+	m.lastLogTime = now
+}
+
+// migrate copies every block of the source database to the destination
+// database in height order.
+func (m *migrator) migrate() error {
+	newestHash, newestHeight, err := m.src.NewestSha()
+	if err != nil {
+		return err
+	}
+	log.Infof("Migrating %d blocks", newestHeight+1)
+
+	m.lastLogTime = time.Now()
+	var prevHash *btcwire.ShaHash
+	for height := int64(0); height <= newestHeight; height++ {
+		prevHash, err = m.migrateBlock(height, prevHash)
+		if err != nil {
+			return err
+		}
+		m.logProgress(newestHeight)
+	}
+
+	// Both databases must agree on the best chain.
+	dstHash, dstHeight, err := m.dst.NewestSha()
+	if err != nil {
+		return err
+	}
+	if dstHeight != newestHeight || !dstHash.IsEqual(newestHash) {
+		return fmt.Errorf("the destination database ends at block %v "+
+			"(height %d) instead of %v (height %d)", dstHash,
+			dstHeight, newestHash, newestHeight)
+	}
+	return m.dst.Sync()
+}
+
+// realMain is the real main function for the utility.  It is necessary to work
+// around the fact that deferred functions do not run when os.Exit() is called.
+func realMain() error {
+	// Load configuration and parse command line.
+	tcfg, _, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg = tcfg
+	defer xlog.Flush()
+
+	// Open the source database, which must exist.
+	srcPath := blockDbPath(cfg.DataDir, cfg.SrcDbType)
+	log.Infof("Loading source block database from '%s'",
+		logformat.F("path", srcPath))
+	src, err := btcdb.OpenDB(cfg.SrcDbType, srcPath)
+	if err != nil {
+		log.Errorf("Failed to load source database: %v", err)
+		return err
+	}
+	defer src.Close()
+
+	// A memdb destination is a snapshot of the source which only lives
+	// for the duration of the migration, so the source is verified
+	// without writing anything.
+	if cfg.DstDbType == "memdb" {
+		log.Infof("Creating in-memory snapshot of the source database")
+		dst, err := btcdb.CreateDB(cfg.DstDbType)
+		if err != nil {
+			log.Errorf("Failed to create destination database: %v",
+				err)
+			return err
+		}
+		defer dst.Close()
+
+		m := &migrator{src: src, dst: dst}
+		if err := m.migrate(); err != nil {
+			log.Errorf("Snapshot failed: %v", err)
+			return err
+		}
+		log.Infof("Verified a total of %d blocks (%d transactions) "+
+			"in a memdb snapshot of the %s database, which is "+
+			"discarded on exit", m.blocksMigrated, m.txMigrated,
+			cfg.SrcDbType)
+		return nil
+	}
+
+	// Create the destination database, which must not exist yet so
+	// nothing is overwritten.
+	dstPath := blockDbPath(cfg.DstDataDir, cfg.DstDbType)
+	if fileExists(dstPath) {
+		err := fmt.Errorf("the destination database %s already exists",
+			dstPath)
+		log.Errorf("%v", err)
+		return err
+	}
+	err = os.MkdirAll(cfg.DstDataDir, 0700)
+	if err != nil {
+		log.Errorf("Failed to create data directory: %v", err)
+		return err
+	}
+	log.Infof("Creating destination block database at '%s'",
+		logformat.F("path", dstPath))
+	dst, err := btcdb.CreateDB(cfg.DstDbType, dstPath)
+	if err != nil {
+		log.Errorf("Failed to create destination database: %v", err)
+		return err
+	}
+
+	m := &migrator{src: src, dst: dst}
+	err = m.migrate()
+	dst.Close()
+	if err != nil {
+		// Remove the incomplete destination database so btcd can't be
+		// started with it by mistake.
+		os.RemoveAll(dstPath)
+		log.Errorf("Migration failed: %v", err)
+		return err
+	}
+
+	log.Infof("Migrated a total of %d blocks (%d transactions) from %s "+
+		"to %s", m.blocksMigrated, m.txMigrated, cfg.SrcDbType,
+		cfg.DstDbType)
+	if cfg.DstDataDir == cfg.DataDir {
+		log.Infof("Start btcd with --dbtype=%s to use the new "+
+			"database.  The %s database at %s may be removed once "+
+			"it is no longer needed", cfg.DstDbType, cfg.SrcDbType,
+			srcPath)
+	}
+	return nil
+}
+
+func main() {
+	// Use all processor cores and up some limits.
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	if err := limits.SetLimits(); err != nil {
+		os.Exit(1)
+	}
+
+	// Work around defer not working after os.Exit()
+	if err := realMain(); err != nil {
+		os.Exit(1)
+	}
+}
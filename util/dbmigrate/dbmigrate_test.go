@@ -0,0 +1,102 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hlandauf/btcdb"
+	"github.com/hlandauf/btcutil"
+	"github.com/hlandauf/btcwire"
+)
+
+// testChain returns a chain of the passed number of blocks which starts with
+// the genesis block of the active network.  Each block after the genesis block
+// only has a coinbase transaction.
+func testChain(t *testing.T, n int) []*btcutil.Block {
+	genesis := activeNetParams.GenesisBlock
+	blocks := []*btcutil.Block{btcutil.NewBlock(genesis)}
+	prevHash, err := genesis.Header.BlockSha()
+	if err != nil {
+		t.Fatalf("unable to hash genesis block: %v", err)
+	}
+	for i := 1; i < n; i++ {
+		coinbase := btcwire.NewMsgTx()
+		coinbase.AddTxIn(btcwire.NewTxIn(btcwire.NewOutPoint(
+			&btcwire.ShaHash{}, ^uint32(0)), []byte{byte(i), 0}))
+		coinbase.AddTxOut(btcwire.NewTxOut(50e8, []byte{0x51}))
+
+		header := btcwire.NewBlockHeader(&prevHash, &btcwire.ShaHash{},
+			genesis.Header.Bits, uint32(i))
+		msgBlock := btcwire.NewMsgBlock(header)
+		msgBlock.AddTransaction(coinbase)
+		blocks = append(blocks, btcutil.NewBlock(msgBlock))
+
+		prevHash, err = header.BlockSha()
+		if err != nil {
+			t.Fatalf("unable to hash block %d: %v", i, err)
+		}
+	}
+	return blocks
+}
+
+// testDb returns an in-memory database which contains the passed blocks.
+func testDb(t *testing.T, blocks []*btcutil.Block) btcdb.Db {
+	db, err := btcdb.CreateDB("memdb")
+	if err != nil {
+		t.Fatalf("unable to create database: %v", err)
+	}
+	for _, block := range blocks {
+		if _, err := db.InsertBlock(block); err != nil {
+			t.Fatalf("unable to insert block: %v", err)
+		}
+	}
+	return db
+}
+
+// TestMigrate ensures every block is copied to the destination database and
+// that a destination which does not match the source is reported.
+func TestMigrate(t *testing.T) {
+	cfg = &config{}
+	blocks := testChain(t, 5)
+	src := testDb(t, blocks)
+	defer src.Close()
+
+	dst := testDb(t, nil)
+	defer dst.Close()
+	m := &migrator{src: src, dst: dst}
+	if err := m.migrate(); err != nil {
+		t.Fatalf("migrate: unexpected error: %v", err)
+	}
+	if m.blocksMigrated != 5 || m.txMigrated != 5 {
+		t.Errorf("migrate: unexpected counts - got %d blocks and %d "+
+			"transactions, want 5 and 5", m.blocksMigrated,
+			m.txMigrated)
+	}
+	srcHash, srcHeight, _ := src.NewestSha()
+	dstHash, dstHeight, err := dst.NewestSha()
+	if err != nil || dstHeight != srcHeight || !dstHash.IsEqual(srcHash) {
+		t.Errorf("migrate: unexpected newest block - got %v (height "+
+			"%d), want %v (height %d)", dstHash, dstHeight, srcHash,
+			srcHeight)
+	}
+	for _, block := range blocks {
+		for _, tx := range block.Transactions() {
+			exists, err := dst.ExistsTxSha(tx.Sha())
+			if err != nil || !exists {
+				t.Errorf("migrate: transaction %v not indexed",
+					tx.Sha())
+			}
+		}
+	}
+
+	// A destination which already contains blocks can't be migrated to.
+	dst = testDb(t, blocks[:1])
+	defer dst.Close()
+	m = &migrator{src: src, dst: dst}
+	if err := m.migrate(); err == nil {
+		t.Errorf("migrate: unexpected success for non-empty destination")
+	}
+}
@@ -13,6 +13,8 @@ import (
 
 	"github.com/hlandau/xlog"
 	flags "github.com/conformal/go-flags"
+	"github.com/hlandauf/btcd/logformat"
+	"github.com/hlandauf/btcd/nmcnet"
 	"github.com/hlandauf/btcdb"
 	_ "github.com/hlandauf/btcdb/ldb"
 	"github.com/hlandauf/btcnet"
@@ -28,13 +30,15 @@ type config struct {
 	TestNet3       bool   `long:"testnet" description:"Use the test network"`
 	RegressionTest bool   `long:"regtest" description:"Use the regression test network"`
 	SimNet         bool   `long:"simnet" description:"Use the simulation test network"`
+	NetParams      string `long:"netparams" description:"Use the custom network defined by the given JSON parameters file"`
 	ShaString      string `short:"s" description:"Block SHA to process" required:"true"`
+	LogFormat      string `long:"logformat" description:"Format of log output {text, json}"`
 }
 
 var (
 	btcdHomeDir     = btcutil.AppDataDir("btcd", false)
 	defaultDataDir  = filepath.Join(btcdHomeDir, "data")
-	activeNetParams = &btcnet.MainNetParams
+	activeNetParams = &btcnet.NmcMainNetParams
 )
 
 var log, Log = xlog.New("dropafter", xlog.SevDebug)
@@ -64,8 +68,9 @@ func netName(netParams *btcnet.Params) string {
 
 func main() {
 	cfg := config{
-		DbType:  "leveldb",
-		DataDir: defaultDataDir,
+		DbType:    "leveldb",
+		DataDir:   defaultDataDir,
+		LogFormat: logformat.Text,
 	}
 	parser := flags.NewParser(&cfg, flags.Default)
 	_, err := parser.Parse()
@@ -81,26 +86,45 @@ func main() {
 	//log = btclog.NewSubsystemLogger(backendLogger, "")
 	//btcdb.UseLogger(log)
 
-	// Multiple networks can't be selected simultaneously.
 	funcName := "main"
+	if err := logformat.SetFormat(cfg.LogFormat); err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return
+	}
+
+	// Multiple networks can't be selected simultaneously.
 	numNets := 0
 	// Count number of network flags passed; assign active network params
 	// while we're at it
 	if cfg.TestNet3 {
 		numNets++
-		activeNetParams = &btcnet.TestNet3Params
+		activeNetParams = &nmcnet.TestNetParams
 	}
 	if cfg.RegressionTest {
 		numNets++
-		activeNetParams = &btcnet.RegressionNetParams
+		activeNetParams = &nmcnet.RegressionNetParams
 	}
 	if cfg.SimNet {
 		numNets++
 		activeNetParams = &btcnet.SimNetParams
 	}
+	if cfg.NetParams != "" {
+		numNets++
+		params, err := nmcnet.LoadParamsFile(cfg.NetParams)
+		if err != nil {
+			str := "%s: Unable to load network parameters from %s: %v"
+			err := fmt.Errorf(str, funcName, cfg.NetParams, err)
+			fmt.Fprintln(os.Stderr, err)
+			parser.WriteHelp(os.Stderr)
+			return
+		}
+		activeNetParams = params
+	}
 	if numNets > 1 {
-		str := "%s: The testnet, regtest, and simnet params can't be " +
-			"used together -- choose one of the three"
+		str := "%s: The testnet, regtest, simnet, and netparams options " +
+			"can't be used together -- choose one of the four"
 		err := fmt.Errorf(str, funcName)
 		fmt.Fprintln(os.Stderr, err)
 		parser.WriteHelp(os.Stderr)
@@ -125,7 +149,7 @@ func main() {
 	log.Infof("db load complete")
 
 	_, height, err := db.NewestSha()
-	log.Infof("loaded block height %v", height)
+	log.Infof("loaded block height %v", logformat.F("height", height))
 
 	sha, err := getSha(db, cfg.ShaString)
 	if err != nil {
@@ -135,7 +159,8 @@ func main() {
 
 	err = db.DropAfterBlockBySha(&sha)
 	if err != nil {
-		log.Warnf("failed %v", err)
+		log.Warnf("failed to drop blocks after %v: %v",
+			logformat.F("hash", &sha), err)
 	}
 
 }
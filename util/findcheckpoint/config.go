@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 
 	flags "github.com/conformal/go-flags"
+	"github.com/hlandauf/btcd/nmcnet"
 	"github.com/hlandauf/btcdb"
 	_ "github.com/hlandauf/btcdb/ldb"
 	"github.com/hlandauf/btcnet"
@@ -28,7 +29,7 @@ var (
 	btcdHomeDir     = btcutil.AppDataDir("btcd", false)
 	defaultDataDir  = filepath.Join(btcdHomeDir, "data")
 	knownDbTypes    = btcdb.SupportedDBs()
-	activeNetParams = &btcnet.MainNetParams
+	activeNetParams = &btcnet.NmcMainNetParams
 )
 
 // config defines the configuration options for findcheckpoint.
@@ -40,6 +41,7 @@ type config struct {
 	TestNet3       bool   `long:"testnet" description:"Use the test network"`
 	RegressionTest bool   `long:"regtest" description:"Use the regression test network"`
 	SimNet         bool   `long:"simnet" description:"Use the simulation test network"`
+	NetParams      string `long:"netparams" description:"Use the custom network defined by the given JSON parameters file"`
 	NumCandidates  int    `short:"n" long:"numcandidates" description:"Max num of checkpoint candidates to show {1-20}"`
 	UseGoOutput    bool   `short:"g" long:"gooutput" description:"Display the candidates using Go syntax that is ready to insert into the btcchain checkpoint list"`
 }
@@ -99,19 +101,31 @@ func loadConfig() (*config, []string, error) {
 	// while we're at it
 	if cfg.TestNet3 {
 		numNets++
-		activeNetParams = &btcnet.TestNet3Params
+		activeNetParams = &nmcnet.TestNetParams
 	}
 	if cfg.RegressionTest {
 		numNets++
-		activeNetParams = &btcnet.RegressionNetParams
+		activeNetParams = &nmcnet.RegressionNetParams
 	}
 	if cfg.SimNet {
 		numNets++
 		activeNetParams = &btcnet.SimNetParams
 	}
+	if cfg.NetParams != "" {
+		numNets++
+		params, err := nmcnet.LoadParamsFile(cfg.NetParams)
+		if err != nil {
+			str := "%s: Unable to load network parameters from %s: %v"
+			err := fmt.Errorf(str, funcName, cfg.NetParams, err)
+			fmt.Fprintln(os.Stderr, err)
+			parser.WriteHelp(os.Stderr)
+			return nil, nil, err
+		}
+		activeNetParams = params
+	}
 	if numNets > 1 {
-		str := "%s: The testnet, regtest, and simnet params can't be " +
-			"used together -- choose one of the three"
+		str := "%s: The testnet, regtest, simnet, and netparams options " +
+			"can't be used together -- choose one of the four"
 		err := fmt.Errorf(str, funcName)
 		fmt.Fprintln(os.Stderr, err)
 		parser.WriteHelp(os.Stderr)
@@ -0,0 +1,66 @@
+// Copyright (c) 2013-2014 Conformal Systems LLC.
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	flags "github.com/conformal/go-flags"
+)
+
+type config struct {
+	User        string `short:"u" long:"user" description:"Name of the RPC account" required:"true"`
+	Password    string `short:"p" long:"password" default-mask:"-" description:"Password of the RPC account -- A random one is generated if not specified"`
+	Permissions string `short:"r" long:"permissions" description:"+ separated list of method names and the roles admin, readonly and mining"`
+}
+
+// randomHex returns n random bytes in hex encoding.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func main() {
+	cfg := config{
+		Permissions: "readonly",
+	}
+	parser := flags.NewParser(&cfg, flags.Default)
+	_, err := parser.Parse()
+	if err != nil {
+		if e, ok := err.(*flags.Error); !ok || e.Type != flags.ErrHelp {
+			parser.WriteHelp(os.Stderr)
+		}
+		return
+	}
+
+	if cfg.Password == "" {
+		cfg.Password, err = randomHex(32)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot generate password: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Password: %s\n", cfg.Password)
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot generate salt: %v\n", err)
+		os.Exit(1)
+	}
+
+	// The hash is the HMAC-SHA256 of the password keyed with the salt, as
+	// used by Bitcoin Core.
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(cfg.Password))
+	fmt.Printf("rpcauth=%s:%s$%x:%s\n", cfg.User, salt, mac.Sum(nil),
+		cfg.Permissions)
+}
@@ -16,6 +16,8 @@ import (
 	"github.com/hlandau/xlog"
 	flags "github.com/conformal/go-flags"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/hlandauf/btcd/logformat"
+	"github.com/hlandauf/btcd/nmcnet"
 	"github.com/hlandauf/btcdb"
 	_ "github.com/hlandauf/btcdb/ldb"
 	"github.com/hlandauf/btcnet"
@@ -31,6 +33,7 @@ type config struct {
 	TestNet3       bool   `long:"testnet" description:"Use the test network"`
 	RegressionTest bool   `long:"regtest" description:"Use the regression test network"`
 	SimNet         bool   `long:"simnet" description:"Use the simulation test network"`
+	NetParams      string `long:"netparams" description:"Use the custom network defined by the given JSON parameters file"`
 	OutFile        string `short:"o" description:"outfile"`
 	Progress       bool   `short:"p" description:"show progress"`
 	ShaString      string `short:"s" description:"Block SHA to process" required:"true"`
@@ -38,12 +41,13 @@ type config struct {
 	RawBlock       bool   `short:"r" description:"Raw Block"`
 	FmtBlock       bool   `short:"f" description:"Format Block"`
 	ShowTx         bool   `short:"t" description:"Show transaction"`
+	LogFormat      string `long:"logformat" description:"Format of log output {text, json}"`
 }
 
 var (
 	btcdHomeDir     = btcutil.AppDataDir("btcd", false)
 	defaultDataDir  = filepath.Join(btcdHomeDir, "data")
-	activeNetParams = &btcnet.MainNetParams
+	activeNetParams = &btcnet.NmcMainNetParams
 )
 
 var log, Log = xlog.New("showblock", xlog.SevDebug)
@@ -75,8 +79,9 @@ func main() {
 	end := int64(-1)
 
 	cfg := config{
-		DbType:  "leveldb",
-		DataDir: defaultDataDir,
+		DbType:    "leveldb",
+		DataDir:   defaultDataDir,
+		LogFormat: logformat.Text,
 	}
 	parser := flags.NewParser(&cfg, flags.Default)
 	_, err := parser.Parse()
@@ -92,26 +97,45 @@ func main() {
 	//log = btclog.NewSubsystemLogger(backendLogger, "")
 	//btcdb.UseLogger(log)
 
-	// Multiple networks can't be selected simultaneously.
 	funcName := "main"
+	if err := logformat.SetFormat(cfg.LogFormat); err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		parser.WriteHelp(os.Stderr)
+		return
+	}
+
+	// Multiple networks can't be selected simultaneously.
 	numNets := 0
 	// Count number of network flags passed; assign active network params
 	// while we're at it
 	if cfg.TestNet3 {
 		numNets++
-		activeNetParams = &btcnet.TestNet3Params
+		activeNetParams = &nmcnet.TestNetParams
 	}
 	if cfg.RegressionTest {
 		numNets++
-		activeNetParams = &btcnet.RegressionNetParams
+		activeNetParams = &nmcnet.RegressionNetParams
 	}
 	if cfg.SimNet {
 		numNets++
 		activeNetParams = &btcnet.SimNetParams
 	}
+	if cfg.NetParams != "" {
+		numNets++
+		params, err := nmcnet.LoadParamsFile(cfg.NetParams)
+		if err != nil {
+			str := "%s: Unable to load network parameters from %s: %v"
+			err := fmt.Errorf(str, funcName, cfg.NetParams, err)
+			fmt.Fprintln(os.Stderr, err)
+			parser.WriteHelp(os.Stderr)
+			return
+		}
+		activeNetParams = params
+	}
 	if numNets > 1 {
-		str := "%s: The testnet, regtest, and simnet params can't be " +
-			"used together -- choose one of the three"
+		str := "%s: The testnet, regtest, simnet, and netparams options " +
+			"can't be used together -- choose one of the four"
 		err := fmt.Errorf(str, funcName)
 		fmt.Fprintln(os.Stderr, err)
 		parser.WriteHelp(os.Stderr)
@@ -150,7 +174,7 @@ func main() {
 		end = height + 1
 	}
 
-	log.Infof("height %v end %v", height, end)
+	log.Infof("height %v end %v", logformat.F("height", height), end)
 
 	var fo io.WriteCloser
 	if cfg.OutFile != "" {
@@ -167,7 +191,8 @@ func main() {
 
 	for ; height < end; height++ {
 		if cfg.Progress && height%int64(1) == 0 {
-			log.Infof("Processing block %v", height)
+			log.Infof("Processing block %v",
+				logformat.F("height", height))
 		}
 		err = DumpBlock(db, height, fo, cfg.RawBlock, cfg.FmtBlock, cfg.ShowTx)
 		if err != nil {
@@ -176,7 +201,7 @@ func main() {
 	}
 	if cfg.Progress {
 		height--
-		log.Infof("Processing block %v", height)
+		log.Infof("Processing block %v", logformat.F("height", height))
 	}
 }
 
@@ -193,7 +218,7 @@ func getHeight(db btcdb.Db, str string) (int64, error) {
 		blk, err := db.FetchBlockBySha(sha)
 		if err != nil {
 			log.Warnf("unable to locate block sha %v err %v",
-				sha, err)
+				logformat.F("hash", sha), err)
 			return 0, err
 		}
 		idx = blk.Height()
@@ -210,19 +235,22 @@ func DumpBlock(db btcdb.Db, height int64, fo io.Writer, rflag bool, fflag bool,
 	}
 	blk, err := db.FetchBlockBySha(sha)
 	if err != nil {
-		log.Warnf("Failed to fetch block %v, err %v", sha, err)
+		log.Warnf("Failed to fetch block %v, err %v",
+			logformat.F("hash", sha), err)
 		return err
 	}
 	rblk, err := blk.Bytes()
 	blkid := blk.Height()
 
 	if rflag {
-		log.Infof("Block %v depth %v %v", sha, blkid, spew.Sdump(rblk))
+		log.Infof("Block %v depth %v %v", logformat.F("hash", sha),
+			logformat.F("height", blkid), spew.Sdump(rblk))
 	}
 
 	mblk := blk.MsgBlock()
 	if fflag {
-		log.Infof("Block %v depth %v %v", sha, blkid, spew.Sdump(mblk))
+		log.Infof("Block %v depth %v %v", logformat.F("hash", sha),
+			logformat.F("height", blkid), spew.Sdump(mblk))
 	}
 	if tflag {
 		log.Infof("Num transactions %v", len(mblk.Transactions))